@@ -0,0 +1,232 @@
+package bondhome
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/ssmall/bondhome-mqtt/metrics"
+)
+
+// Names of the actions that devices support, see http://docs-local.appbond.com/#section/Actions
+const (
+	ActionTurnOn             = "TurnOn"
+	ActionTurnOff            = "TurnOff"
+	ActionTogglePower        = "TogglePower"
+	ActionTurnLightOn        = "TurnLightOn"
+	ActionTurnLightOff       = "TurnLightOff"
+	ActionToggleLight        = "ToggleLight"
+	ActionSetSpeed           = "SetSpeed"
+	ActionIncreaseSpeed      = "IncreaseSpeed"
+	ActionDecreaseSpeed      = "DecreaseSpeed"
+	ActionSetDirection       = "SetDirection"
+	ActionToggleDirection    = "ToggleDirection"
+	ActionSetBrightness      = "SetBrightness"
+	ActionIncreaseBrightness = "IncreaseBrightness"
+	ActionDecreaseBrightness = "DecreaseBrightness"
+	ActionSetFlame           = "SetFlame"
+	ActionIncreaseFlame      = "IncreaseFlame"
+	ActionDecreaseFlame      = "DecreaseFlame"
+	ActionOpen               = "Open"
+	ActionClose              = "Close"
+	ActionHold               = "Hold"
+	ActionSetPosition        = "SetPosition"
+	ActionSetTimer           = "SetTimer"
+)
+
+// argumentRange is the range of the integer argument of an action;
+// a max of zero means the argument has no upper bound
+type argumentRange struct {
+	min, max int
+}
+
+// intArguments lists the actions that require an integer argument, and its range.
+// The maximum speed of SetSpeed depends on the device, see Action.Validate.
+var intArguments = map[string]argumentRange{
+	ActionSetSpeed:           {1, 0},
+	ActionIncreaseSpeed:      {1, 0},
+	ActionDecreaseSpeed:      {1, 0},
+	ActionSetDirection:       {-1, 1},
+	ActionSetBrightness:      {1, 100},
+	ActionIncreaseBrightness: {1, 100},
+	ActionDecreaseBrightness: {1, 100},
+	ActionSetFlame:           {1, 100},
+	ActionIncreaseFlame:      {1, 100},
+	ActionDecreaseFlame:      {1, 100},
+	ActionSetPosition:        {0, 100},
+	ActionSetTimer:           {0, 0},
+}
+
+// Action is an action to execute on a device or group, with its argument if it takes one
+type Action struct {
+	Name string
+	// Argument is nil for actions without an argument
+	Argument interface{}
+}
+
+// TurnOn returns the action that turns a device on
+func TurnOn() Action { return Action{Name: ActionTurnOn} }
+
+// TurnOff returns the action that turns a device off
+func TurnOff() Action { return Action{Name: ActionTurnOff} }
+
+// TogglePower returns the action that turns a device on if it is off, and off if it is on
+func TogglePower() Action { return Action{Name: ActionTogglePower} }
+
+// TurnLightOn returns the action that turns the light of a ceiling fan on
+func TurnLightOn() Action { return Action{Name: ActionTurnLightOn} }
+
+// TurnLightOff returns the action that turns the light of a ceiling fan off
+func TurnLightOff() Action { return Action{Name: ActionTurnLightOff} }
+
+// SetSpeed returns the action that sets the speed of a fan, from 1 to its maximum speed
+func SetSpeed(speed int) Action { return Action{Name: ActionSetSpeed, Argument: speed} }
+
+// SetDirection returns the action that sets the direction of a ceiling fan:
+// 1 for forward (summer) and -1 for reverse (winter)
+func SetDirection(direction int) Action {
+	return Action{Name: ActionSetDirection, Argument: direction}
+}
+
+// SetBrightness returns the action that sets the brightness of a light, in percent from 1 to 100
+func SetBrightness(percent int) Action {
+	return Action{Name: ActionSetBrightness, Argument: percent}
+}
+
+// SetFlame returns the action that sets the flame height of a fireplace, in percent from 1 to 100
+func SetFlame(percent int) Action { return Action{Name: ActionSetFlame, Argument: percent} }
+
+// Open returns the action that opens shades
+func Open() Action { return Action{Name: ActionOpen} }
+
+// Close returns the action that closes shades
+func Close() Action { return Action{Name: ActionClose} }
+
+// Hold returns the action that stops shades that are opening or closing
+func Hold() Action { return Action{Name: ActionHold} }
+
+// SetPosition returns the action that moves shades to a position, in
+// percent from 0 (open) to 100 (closed)
+func SetPosition(percent int) Action {
+	return Action{Name: ActionSetPosition, Argument: percent}
+}
+
+// SetTimer returns the action that turns a device off after a number
+// of seconds, or cancels the timer if seconds is 0
+func SetTimer(seconds int) Action { return Action{Name: ActionSetTimer, Argument: seconds} }
+
+// ParseAction returns the action with the given name and the argument given by
+// payload, which is either {"argument": <argument>}, the argument itself, or
+// empty for no argument. Arguments of actions that take an integer are checked
+// to be one, other arguments are passed on to the bridge as they are.
+func ParseAction(name string, payload []byte) (Action, error) {
+	a := Action{Name: name}
+
+	argument := bytes.TrimSpace(payload)
+	var object map[string]json.RawMessage
+	if json.Unmarshal(argument, &object) == nil {
+		argument = object["argument"]
+		for field := range object {
+			if field != "argument" {
+				return a, fmt.Errorf("unexpected field %q in payload %q of action %s", field, payload, name)
+			}
+		}
+	}
+	if len(argument) == 0 {
+		return a, nil
+	}
+	if !json.Valid(argument) {
+		return a, fmt.Errorf("argument %q of action %s is not valid JSON", argument, name)
+	}
+
+	if _, ok := intArguments[name]; ok {
+		var n int
+		if err := json.Unmarshal(argument, &n); err != nil {
+			return a, fmt.Errorf("argument %s of action %s is not an integer", argument, name)
+		}
+		a.Argument = n
+		return a, nil
+	}
+	a.Argument = json.RawMessage(argument)
+	return a, nil
+}
+
+// Validate checks that the action is one of the supported actions of a
+// device or group, and that its argument, if it takes an integer, is in
+// range. The maximum speed of a device is checked if its properties are given.
+func (a Action) Validate(supported []string, properties *DeviceProperties) error {
+	if !contains(supported, a.Name) {
+		return fmt.Errorf("action %s is not supported", a.Name)
+	}
+
+	r, ok := intArguments[a.Name]
+	if !ok {
+		return nil
+	}
+	if a.Name == ActionSetSpeed && properties != nil {
+		r.max = properties.MaxSpeed
+	}
+
+	n, ok := a.Argument.(int)
+	switch {
+	case !ok:
+		return fmt.Errorf("action %s requires an integer argument", a.Name)
+	case n < r.min:
+		return fmt.Errorf("argument %d of action %s is below its minimum of %d", n, a.Name, r.min)
+	case r.max > 0 && n > r.max:
+		return fmt.Errorf("argument %d of action %s is above its maximum of %d", n, a.Name, r.max)
+	case a.Name == ActionSetDirection && n == 0:
+		return fmt.Errorf("argument of action %s must be 1 (forward) or -1 (reverse)", a.Name)
+	}
+	return nil
+}
+
+type executeActionArg struct {
+	Argument interface{} `json:"argument"`
+}
+
+// JSON returns the body of the request that executes the action
+func (a Action) JSON() (string, error) {
+	if a.Argument == nil {
+		return "{}", nil
+	}
+	b, err := json.Marshal(executeActionArg{Argument: a.Argument})
+	if err != nil {
+		return "", fmt.Errorf("error marshaling argument of action %s: %w", a.Name, err)
+	}
+	return string(b), nil
+}
+
+// Execute executes an action on a device
+func Execute(ctx context.Context, b Bridge, deviceID string, a Action) error {
+	body, err := a.JSON()
+	if err != nil {
+		return err
+	}
+	err = b.ExecuteAction(ctx, deviceID, a.Name, body)
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	metrics.ActionsExecuted.WithLabelValues(deviceID, a.Name, result).Inc()
+	return err
+}
+
+// ExecuteGroup executes an action on every device of a group
+func ExecuteGroup(ctx context.Context, b Bridge, groupID string, a Action) error {
+	body, err := a.JSON()
+	if err != nil {
+		return err
+	}
+	return b.ExecuteGroupAction(ctx, groupID, a.Name, body)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
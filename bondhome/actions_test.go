@@ -0,0 +1,88 @@
+package bondhome
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func Test_ParseAction(t *testing.T) {
+	tests := []struct {
+		name     string
+		payload  string
+		expected Action
+		valid    bool
+	}{
+		{ActionSetSpeed, `{"argument": 3}`, SetSpeed(3), true},
+		{ActionSetSpeed, `4`, SetSpeed(4), true},
+		{ActionSetSpeed, `{"argument": "fast"}`, Action{}, false},
+		{ActionSetSpeed, `2.5`, Action{}, false},
+		{ActionSetSpeed, `{}`, Action{Name: ActionSetSpeed}, true},
+		{ActionTurnOn, ``, TurnOn(), true},
+		{ActionTurnOn, `{}`, TurnOn(), true},
+		{ActionSetPosition, ` 30 `, SetPosition(30), true},
+		{"Preset", `"sleep"`, Action{Name: "Preset", Argument: json.RawMessage(`"sleep"`)}, true},
+		{"Preset", `sleep`, Action{}, false},
+		{ActionTurnOn, `{"body": 1}`, Action{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+" "+tt.payload, func(t *testing.T) {
+			action, err := ParseAction(tt.name, []byte(tt.payload))
+			if (err == nil) != tt.valid {
+				t.Fatalf("expected valid=%v but got error: %v", tt.valid, err)
+			}
+			if !tt.valid {
+				return
+			}
+			expectedJSON, _ := tt.expected.JSON()
+			actualJSON, _ := action.JSON()
+			if action.Name != tt.expected.Name || actualJSON != expectedJSON {
+				t.Fatalf("expected %+v but got %+v", tt.expected, action)
+			}
+		})
+	}
+}
+
+func Test_Action_Validate(t *testing.T) {
+	supported := []string{ActionTurnOn, ActionSetSpeed, ActionSetBrightness, ActionSetDirection}
+	properties := &DeviceProperties{MaxSpeed: 6}
+	tests := []struct {
+		action     Action
+		properties *DeviceProperties
+		valid      bool
+	}{
+		{TurnOn(), nil, true},
+		{TurnOff(), nil, false},
+		{SetSpeed(6), properties, true},
+		{SetSpeed(7), properties, false},
+		{SetSpeed(7), nil, true},
+		{SetSpeed(0), nil, false},
+		{Action{Name: ActionSetSpeed}, nil, false},
+		{SetBrightness(100), nil, true},
+		{SetBrightness(101), nil, false},
+		{SetDirection(-1), nil, true},
+		{SetDirection(0), nil, false},
+	}
+	for _, tt := range tests {
+		err := tt.action.Validate(supported, tt.properties)
+		if (err == nil) != tt.valid {
+			t.Errorf("expected %+v with properties %+v to be valid=%v but got error: %v", tt.action, tt.properties, tt.valid, err)
+		}
+	}
+}
+
+func Test_Action_JSON(t *testing.T) {
+	tests := map[string]Action{
+		`{}`:                 TurnOn(),
+		`{"argument":3}`:     SetSpeed(3),
+		`{"argument":[1,2]}`: {Name: "Preset", Argument: []int{1, 2}},
+	}
+	for expected, action := range tests {
+		actual, err := action.JSON()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if actual != expected {
+			t.Errorf("expected %s but got %s", expected, actual)
+		}
+	}
+}
@@ -2,13 +2,21 @@ package bondhome
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/golang/glog"
+
+	"github.com/ssmall/bondhome-mqtt/metrics"
 )
 
 // Device represents information about the device
@@ -20,41 +28,192 @@ type Device struct {
 	Actions  []string `json:"actions"`
 }
 
+// DeviceProperties represents the configuration of a device
+// retrieved via the following API request: http://docs-local.appbond.com/#tag/Properties/paths/~1v2~1devices~1{device_id}~1properties/get
+// Fields that are unset are omitted when patching the properties.
+type DeviceProperties struct {
+	// Addr is the address of the device's remote, for RF devices
+	Addr string `json:"addr,omitempty"`
+	// Freq is the RF frequency of the device's remote, in kHz
+	Freq int `json:"freq,omitempty"`
+	// BPS is the RF bit rate of the device's remote
+	BPS int `json:"bps,omitempty"`
+	// ZeroGap is the gap between repeated RF transmissions, in ms
+	ZeroGap int `json:"zero_gap,omitempty"`
+	// TrustState is whether the bridge toggles its state when a toggle
+	// action is executed, instead of assuming a known state
+	TrustState *bool `json:"trust_state,omitempty"`
+	// MaxSpeed is the highest speed of a ceiling fan, where 1 is the lowest
+	MaxSpeed int `json:"max_speed,omitempty"`
+}
+
+// Command represents a command of a device, such as a button learned from its
+// remote, retrieved via the following API request: http://docs-local.appbond.com/#tag/Commands/paths/~1v2~1devices~1{device_id}~1commands~1{command_id}/get
+type Command struct {
+	Name       string          `json:"name"`
+	Icon       string          `json:"icon"`
+	CategoryID int             `json:"category_id"`
+	Action     string          `json:"action"`
+	Argument   json.RawMessage `json:"argument"`
+}
+
+// Group represents a set of devices that are controlled together
+// retrieved via the following API request: http://docs-local.appbond.com/#tag/Groups/paths/~1v2~1groups~1{group_id}/get
+type Group struct {
+	Name      string   `json:"name"`
+	Devices   []string `json:"devices"`
+	Types     []string `json:"types"`
+	Locations []string `json:"locations"`
+	Actions   []string `json:"actions"`
+}
+
+// Sked is a schedule that executes an action of a device, see
+// http://docs-local.appbond.com/#tag/Schedules. Fields that are unset
+// are omitted when creating or patching a schedule.
+type Sked struct {
+	// ID is set by the bridge in response to creating a schedule
+	ID       string          `json:"__id,omitempty"`
+	Action   string          `json:"action,omitempty"`
+	Argument json.RawMessage `json:"argument,omitempty"`
+	// Weekdays is a bitmask of the days to run on, starting with Sunday as bit 0
+	Weekdays *int `json:"weekdays,omitempty"`
+	// Mark is the time of day that Minutes are relative to:
+	// "midnight", "sunrise" or "sunset"
+	Mark    string `json:"mark,omitempty"`
+	Minutes *int   `json:"minutes,omitempty"`
+	Enabled *bool  `json:"enabled,omitempty"`
+}
+
 // Bridge interface is used to communicate with the Bond bridge
 type Bridge interface {
-	ExecuteAction(deviceID string, actionID string, argumentJSON string) error
-	GetDevice(deviceID string) (*Device, error)
-	GetDeviceIDs() ([]string, error)
+	ExecuteAction(ctx context.Context, deviceID string, actionID string, argumentJSON string) error
+	GetDevice(ctx context.Context, deviceID string) (*Device, error)
+	GetDeviceIDs(ctx context.Context) ([]string, error)
+	GetDeviceState(ctx context.Context, deviceID string) (json.RawMessage, error)
+	UpdateDeviceState(ctx context.Context, deviceID string, stateJSON string) error
+	GetDeviceProperties(ctx context.Context, deviceID string) (*DeviceProperties, error)
+	PatchDeviceProperties(ctx context.Context, deviceID string, properties *DeviceProperties) error
+	GetCommandIDs(ctx context.Context, deviceID string) ([]string, error)
+	GetCommand(ctx context.Context, deviceID string, commandID string) (*Command, error)
+	ExecuteCommand(ctx context.Context, deviceID string, commandID string) error
+	GetGroupIDs(ctx context.Context) ([]string, error)
+	GetGroup(ctx context.Context, groupID string) (*Group, error)
+	ExecuteGroupAction(ctx context.Context, groupID string, actionID string, argumentJSON string) error
+	GetGroupState(ctx context.Context, groupID string) (json.RawMessage, error)
+	GetSkedIDs(ctx context.Context, deviceID string) ([]string, error)
+	GetSked(ctx context.Context, deviceID string, skedID string) (*Sked, error)
+	CreateSked(ctx context.Context, deviceID string, sked *Sked) (*Sked, error)
+	PatchSked(ctx context.Context, deviceID string, skedID string, sked *Sked) error
+	DeleteSked(ctx context.Context, deviceID string, skedID string) error
+	GetVersion(ctx context.Context) (*Version, error)
+	GetDiagnostics(ctx context.Context) (json.RawMessage, error)
+	GetWiFiStatus(ctx context.Context) (*WiFiStatus, error)
+}
+
+// Resolver looks up the current hostname or IP address of a bridge, e.g.
+// via mDNS, so that clients can find it again if its address changes
+type Resolver func() (string, error)
+
+const (
+	// DefaultRequestTimeout limits each attempt of a request, unless configured otherwise
+	DefaultRequestTimeout = 10 * time.Second
+	// DefaultRequestRetries is how many times a failed request is retried, unless configured otherwise
+	DefaultRequestRetries = 2
+	// DefaultRetryBackoff is the delay before the first retry of a request, unless configured otherwise
+	DefaultRetryBackoff = 250 * time.Millisecond
+)
+
+// sharedClient is used by every Bridge, so that connections
+// to bridges are kept alive and reused between requests
+var sharedClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   5 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+	},
+}
+
+// Option configures a Bridge
+type Option func(*restAPIClient)
+
+// WithTimeout limits how long each attempt of a request may take; zero means no limit
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *restAPIClient) {
+		c.timeout = timeout
+	}
+}
+
+// WithRetries sets how many times a failed request is retried, waiting
+// a jittered backoff that doubles with each retry. Requests that may have
+// changed a device's state, such as toggling it, are only retried if the
+// bridge didn't receive them or was too busy to act on them.
+func WithRetries(retries int, backoff time.Duration) Option {
+	return func(c *restAPIClient) {
+		c.retries = retries
+		c.backoff = backoff
+	}
 }
 
 // NewBridge creates a new BondHome bridge API client
-func NewBridge(hostname string, token string) Bridge {
-	return &restAPIClient{
-		client:   http.DefaultClient,
+func NewBridge(hostname string, token string, opts ...Option) Bridge {
+	return newRestAPIClient(hostname, token, nil, opts)
+}
+
+// NewResolvingBridge creates a new BondHome bridge API client for a
+// bridge whose address is looked up with resolve. The address is looked
+// up again whenever the bridge can't be reached, in case it has changed.
+func NewResolvingBridge(resolve Resolver, token string, opts ...Option) (Bridge, error) {
+	hostname, err := resolve()
+	if err != nil {
+		return nil, fmt.Errorf("error resolving bridge address: %w", err)
+	}
+	return newRestAPIClient(hostname, token, resolve, opts), nil
+}
+
+func newRestAPIClient(hostname string, token string, resolve Resolver, opts []Option) *restAPIClient {
+	c := &restAPIClient{
+		client:   sharedClient,
 		hostname: hostname,
 		token:    token,
+		resolve:  resolve,
+		timeout:  DefaultRequestTimeout,
+		retries:  DefaultRequestRetries,
+		backoff:  DefaultRetryBackoff,
+	}
+	for _, opt := range opts {
+		opt(c)
 	}
+	return c
 }
 
 type restAPIClient struct {
-	client   *http.Client
+	client *http.Client
+	token  string
+	// resolve looks up the bridge's address when it can't be reached, if set
+	resolve Resolver
+	// timeout limits each attempt of a request, if set
+	timeout time.Duration
+	// retries is how many times a failed request is retried
+	retries int
+	// backoff is the delay before the first retry
+	backoff time.Duration
+
+	mu       sync.Mutex
 	hostname string
-	token    string
 }
 
-type executeActionArg struct {
-	Argument interface{} `json:"argument"`
-}
-
-func (c *restAPIClient) ExecuteAction(deviceID string, actionID string, argumentJSON string) error {
-	req, err := c.newRequest(http.MethodPut, fmt.Sprintf("v2/devices/%s/actions/%s", deviceID, actionID), []byte(argumentJSON))
+func (c *restAPIClient) ExecuteAction(ctx context.Context, deviceID string, actionID string, argumentJSON string) error {
+	req, err := c.newRequest(ctx, http.MethodPut, fmt.Sprintf("v2/devices/%s/actions/%s", deviceID, actionID), []byte(argumentJSON))
 	if err != nil {
 		return err
 	}
 
-	glog.V(1).Infof("Sending request: %s %s body=%q", req.Method, req.URL, argumentJSON)
+	glog.V(1).Infof("%sSending request: %s %s body=%q", tracePrefix(ctx), req.Method, req.URL, argumentJSON)
 
-	resp, err := c.client.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return fmt.Errorf("error executing HTTP request: %w", err)
 	}
@@ -66,41 +225,239 @@ func (c *restAPIClient) ExecuteAction(deviceID string, actionID string, argument
 	return nil
 }
 
-func (c *restAPIClient) GetDevice(deviceID string) (*Device, error) {
-	req, err := c.newRequest(http.MethodGet, "v2/devices/"+deviceID, nil)
-	if err != nil {
+func (c *restAPIClient) GetDevice(ctx context.Context, deviceID string) (*Device, error) {
+	device := &Device{}
+	if err := c.get(ctx, "v2/devices/"+deviceID, device); err != nil {
 		return nil, err
 	}
+	return device, nil
+}
 
-	resp, err := c.client.Do(req)
+func (c *restAPIClient) GetDeviceIDs(ctx context.Context) ([]string, error) {
+	return c.getIDs(ctx, "v2/devices")
+}
+
+// getIDs retrieves the IDs listed by a collection of the API,
+// which are the keys of the response that don't start with "_"
+func (c *restAPIClient) getIDs(ctx context.Context, urlPath string) ([]string, error) {
+	var responseObject map[string]interface{}
+	if err := c.get(ctx, urlPath, &responseObject); err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(responseObject))
+
+	for k := range responseObject {
+		if !strings.HasPrefix(k, "_") {
+			ids = append(ids, k)
+		}
+	}
+
+	return ids, nil
+}
+
+// get retrieves the resource at urlPath and unmarshals it into v
+func (c *restAPIClient) get(ctx context.Context, urlPath string, v interface{}) error {
+	req, err := c.newRequest(ctx, http.MethodGet, urlPath, nil)
 	if err != nil {
-		return nil, fmt.Errorf("error executing HTTP request: %w", err)
+		return err
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return fmt.Errorf("error executing HTTP request: %w", err)
 	}
 
 	defer resp.Body.Close()
 
 	if err = expect2xxResponse(resp); err != nil {
+		return err
+	}
+
+	return unmarshalResponseBody(resp, v)
+}
+
+// GetDeviceState retrieves the current state of a device as reported by the bridge, see
+// http://docs-local.appbond.com/#tag/State/paths/~1v2~1devices~1{device_id}~1state/get
+func (c *restAPIClient) GetDeviceState(ctx context.Context, deviceID string) (json.RawMessage, error) {
+	var state json.RawMessage
+	if err := c.get(ctx, "v2/devices/"+deviceID+"/state", &state); err != nil {
 		return nil, err
 	}
+	return state, nil
+}
 
-	deviceResult := &Device{}
+// UpdateDeviceState corrects the bridge's belief of a device's state, without transmitting
+// anything to the device, e.g. after it was controlled with its own remote. See
+// http://docs-local.appbond.com/#tag/State/paths/~1v2~1devices~1{device_id}~1state/patch
+func (c *restAPIClient) UpdateDeviceState(ctx context.Context, deviceID string, stateJSON string) error {
+	req, err := c.newRequest(ctx, http.MethodPatch, "v2/devices/"+deviceID+"/state", []byte(stateJSON))
+	if err != nil {
+		return err
+	}
 
-	err = unmarshalResponseBody(resp, deviceResult)
+	glog.V(1).Infof("%sSending request: %s %s body=%q", tracePrefix(ctx), req.Method, req.URL, stateJSON)
 
+	resp, err := c.do(req)
 	if err != nil {
+		return fmt.Errorf("error executing HTTP request: %w", err)
+	}
+
+	defer resp.Body.Close()
+
+	return expect2xxResponse(resp)
+}
+
+// GetDeviceProperties retrieves the configuration of a device, see
+// http://docs-local.appbond.com/#tag/Properties/paths/~1v2~1devices~1{device_id}~1properties/get
+func (c *restAPIClient) GetDeviceProperties(ctx context.Context, deviceID string) (*DeviceProperties, error) {
+	properties := &DeviceProperties{}
+	if err := c.get(ctx, "v2/devices/"+deviceID+"/properties", properties); err != nil {
 		return nil, err
 	}
+	return properties, nil
+}
+
+// PatchDeviceProperties updates the properties of a device that are set, see
+// http://docs-local.appbond.com/#tag/Properties/paths/~1v2~1devices~1{device_id}~1properties/patch
+func (c *restAPIClient) PatchDeviceProperties(ctx context.Context, deviceID string, properties *DeviceProperties) error {
+	body, err := json.Marshal(properties)
+	if err != nil {
+		return fmt.Errorf("error marshaling properties: %w", err)
+	}
+
+	req, err := c.newRequest(ctx, http.MethodPatch, "v2/devices/"+deviceID+"/properties", body)
+	if err != nil {
+		return err
+	}
+
+	glog.V(1).Infof("%sSending request: %s %s body=%q", tracePrefix(ctx), req.Method, req.URL, body)
+
+	resp, err := c.do(req)
+	if err != nil {
+		return fmt.Errorf("error executing HTTP request: %w", err)
+	}
+
+	defer resp.Body.Close()
+
+	return expect2xxResponse(resp)
+}
 
-	return deviceResult, err
+// GetCommandIDs retrieves the IDs of a device's commands, see
+// http://docs-local.appbond.com/#tag/Commands/paths/~1v2~1devices~1{device_id}~1commands/get
+func (c *restAPIClient) GetCommandIDs(ctx context.Context, deviceID string) ([]string, error) {
+	return c.getIDs(ctx, "v2/devices/"+deviceID+"/commands")
 }
 
-func (c *restAPIClient) GetDeviceIDs() ([]string, error) {
-	req, err := c.newRequest(http.MethodGet, "v2/devices", nil)
+// GetCommand retrieves a command of a device, see
+// http://docs-local.appbond.com/#tag/Commands/paths/~1v2~1devices~1{device_id}~1commands~1{command_id}/get
+func (c *restAPIClient) GetCommand(ctx context.Context, deviceID string, commandID string) (*Command, error) {
+	command := &Command{}
+	if err := c.get(ctx, fmt.Sprintf("v2/devices/%s/commands/%s", deviceID, commandID), command); err != nil {
+		return nil, err
+	}
+	return command, nil
+}
+
+// ExecuteCommand transmits a command of a device, see
+// http://docs-local.appbond.com/#tag/Commands/paths/~1v2~1devices~1{device_id}~1commands~1{command_id}~1tx/put
+func (c *restAPIClient) ExecuteCommand(ctx context.Context, deviceID string, commandID string) error {
+	req, err := c.newRequest(ctx, http.MethodPut, fmt.Sprintf("v2/devices/%s/commands/%s/tx", deviceID, commandID), []byte("{}"))
 	if err != nil {
+		return err
+	}
+
+	glog.V(1).Infof("%sSending request: %s %s", tracePrefix(ctx), req.Method, req.URL)
+
+	resp, err := c.do(req)
+	if err != nil {
+		return fmt.Errorf("error executing HTTP request: %w", err)
+	}
+
+	defer resp.Body.Close()
+
+	return expect2xxResponse(resp)
+}
+
+// GetGroupIDs retrieves the IDs of the bridge's groups, see
+// http://docs-local.appbond.com/#tag/Groups/paths/~1v2~1groups/get
+func (c *restAPIClient) GetGroupIDs(ctx context.Context) ([]string, error) {
+	return c.getIDs(ctx, "v2/groups")
+}
+
+// GetGroup retrieves a group, see
+// http://docs-local.appbond.com/#tag/Groups/paths/~1v2~1groups~1{group_id}/get
+func (c *restAPIClient) GetGroup(ctx context.Context, groupID string) (*Group, error) {
+	group := &Group{}
+	if err := c.get(ctx, "v2/groups/"+groupID, group); err != nil {
 		return nil, err
 	}
+	return group, nil
+}
 
-	resp, err := c.client.Do(req)
+// ExecuteGroupAction executes an action on every device of a group, see
+// http://docs-local.appbond.com/#tag/Groups/paths/~1v2~1groups~1{group_id}~1actions~1{action_id}/put
+func (c *restAPIClient) ExecuteGroupAction(ctx context.Context, groupID string, actionID string, argumentJSON string) error {
+	req, err := c.newRequest(ctx, http.MethodPut, fmt.Sprintf("v2/groups/%s/actions/%s", groupID, actionID), []byte(argumentJSON))
+	if err != nil {
+		return err
+	}
+
+	glog.V(1).Infof("%sSending request: %s %s body=%q", tracePrefix(ctx), req.Method, req.URL, argumentJSON)
+
+	resp, err := c.do(req)
+	if err != nil {
+		return fmt.Errorf("error executing HTTP request: %w", err)
+	}
+
+	defer resp.Body.Close()
+
+	return expect2xxResponse(resp)
+}
+
+// GetGroupState retrieves the state of a group, see
+// http://docs-local.appbond.com/#tag/Groups/paths/~1v2~1groups~1{group_id}~1state/get
+func (c *restAPIClient) GetGroupState(ctx context.Context, groupID string) (json.RawMessage, error) {
+	var state json.RawMessage
+	if err := c.get(ctx, "v2/groups/"+groupID+"/state", &state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// GetSkedIDs retrieves the IDs of a device's schedules, see
+// http://docs-local.appbond.com/#tag/Schedules/paths/~1v2~1devices~1{device_id}~1skeds/get
+func (c *restAPIClient) GetSkedIDs(ctx context.Context, deviceID string) ([]string, error) {
+	return c.getIDs(ctx, "v2/devices/"+deviceID+"/skeds")
+}
+
+// GetSked retrieves a schedule of a device, see
+// http://docs-local.appbond.com/#tag/Schedules/paths/~1v2~1devices~1{device_id}~1skeds~1{sked_id}/get
+func (c *restAPIClient) GetSked(ctx context.Context, deviceID string, skedID string) (*Sked, error) {
+	sked := &Sked{}
+	if err := c.get(ctx, fmt.Sprintf("v2/devices/%s/skeds/%s", deviceID, skedID), sked); err != nil {
+		return nil, err
+	}
+	sked.ID = skedID
+	return sked, nil
+}
+
+// CreateSked adds a schedule to a device, returning the schedule as created by the bridge, see
+// http://docs-local.appbond.com/#tag/Schedules/paths/~1v2~1devices~1{device_id}~1skeds/post
+func (c *restAPIClient) CreateSked(ctx context.Context, deviceID string, sked *Sked) (*Sked, error) {
+	body, err := json.Marshal(sked)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling schedule: %w", err)
+	}
+
+	req, err := c.newRequest(ctx, http.MethodPost, "v2/devices/"+deviceID+"/skeds", body)
+	if err != nil {
+		return nil, err
+	}
+
+	glog.V(1).Infof("%sSending request: %s %s body=%q", tracePrefix(ctx), req.Method, req.URL, body)
+
+	resp, err := c.do(req)
 	if err != nil {
 		return nil, fmt.Errorf("error executing HTTP request: %w", err)
 	}
@@ -110,28 +467,72 @@ func (c *restAPIClient) GetDeviceIDs() ([]string, error) {
 	if err = expect2xxResponse(resp); err != nil {
 		return nil, err
 	}
-	var responseObject map[string]interface{}
 
-	err = unmarshalResponseBody(resp, &responseObject)
+	created := &Sked{}
+
+	err = unmarshalResponseBody(resp, created)
 
 	if err != nil {
 		return nil, err
 	}
 
-	ids := make([]string, 0, len(responseObject)-1)
+	return created, nil
+}
 
-	for k := range responseObject {
-		if !strings.HasPrefix(k, "_") {
-			ids = append(ids, k)
-		}
+// PatchSked updates the fields of a device's schedule that are set, see
+// http://docs-local.appbond.com/#tag/Schedules/paths/~1v2~1devices~1{device_id}~1skeds~1{sked_id}/patch
+func (c *restAPIClient) PatchSked(ctx context.Context, deviceID string, skedID string, sked *Sked) error {
+	patch := *sked
+	patch.ID = ""
+	body, err := json.Marshal(&patch)
+	if err != nil {
+		return fmt.Errorf("error marshaling schedule: %w", err)
 	}
 
-	return ids, nil
+	req, err := c.newRequest(ctx, http.MethodPatch, fmt.Sprintf("v2/devices/%s/skeds/%s", deviceID, skedID), body)
+	if err != nil {
+		return err
+	}
+
+	glog.V(1).Infof("%sSending request: %s %s body=%q", tracePrefix(ctx), req.Method, req.URL, body)
+
+	resp, err := c.do(req)
+	if err != nil {
+		return fmt.Errorf("error executing HTTP request: %w", err)
+	}
+
+	defer resp.Body.Close()
+
+	return expect2xxResponse(resp)
 }
 
-func (c *restAPIClient) newRequest(method string, urlPath string, body []byte) (*http.Request, error) {
-	req, err := http.NewRequest(method,
-		fmt.Sprintf("http://%s/%s", c.hostname, urlPath),
+// DeleteSked removes a schedule from a device, see
+// http://docs-local.appbond.com/#tag/Schedules/paths/~1v2~1devices~1{device_id}~1skeds~1{sked_id}/delete
+func (c *restAPIClient) DeleteSked(ctx context.Context, deviceID string, skedID string) error {
+	req, err := c.newRequest(ctx, http.MethodDelete, fmt.Sprintf("v2/devices/%s/skeds/%s", deviceID, skedID), nil)
+	if err != nil {
+		return err
+	}
+
+	glog.V(1).Infof("%sSending request: %s %s", tracePrefix(ctx), req.Method, req.URL)
+
+	resp, err := c.do(req)
+	if err != nil {
+		return fmt.Errorf("error executing HTTP request: %w", err)
+	}
+
+	defer resp.Body.Close()
+
+	return expect2xxResponse(resp)
+}
+
+func (c *restAPIClient) newRequest(ctx context.Context, method string, urlPath string, body []byte) (*http.Request, error) {
+	c.mu.Lock()
+	hostname := c.hostname
+	c.mu.Unlock()
+
+	req, err := http.NewRequestWithContext(ctx, method,
+		fmt.Sprintf("http://%s/%s", hostname, urlPath),
 		bytes.NewBuffer(body))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
@@ -142,11 +543,219 @@ func (c *restAPIClient) newRequest(method string, urlPath string, body []byte) (
 	return req, nil
 }
 
+// do executes a request, retrying it if it fails in a way that is safe to
+// retry. If the bridge can't be reached, its address is resolved again and
+// the request is retried straight away if the address changed. A request
+// that fails without a response returns a *RequestError.
+func (c *restAPIClient) do(req *http.Request) (*http.Response, error) {
+	resp, err := c.send(req)
+	if err != nil {
+		return nil, &RequestError{
+			Method:     req.Method,
+			URL:        req.URL.String(),
+			Err:        err,
+			idempotent: isIdempotent(req),
+		}
+	}
+	return resp, nil
+}
+
+func (c *restAPIClient) send(req *http.Request) (*http.Response, error) {
+	resolved := false
+	for retry := 0; ; {
+		resp, err := c.attempt(req)
+		if err != nil && c.resolve != nil && !resolved && req.Context().Err() == nil {
+			resolved = true
+			if c.reresolve(err) {
+				if req, err = c.rewind(req); err != nil {
+					return nil, err
+				}
+				continue
+			}
+		}
+
+		if retry >= c.retries || !shouldRetry(req, resp, err) {
+			return resp, err
+		}
+		retry++
+
+		delay := jitteredBackoff(c.backoff, retry)
+		if err == nil {
+			err = fmt.Errorf("got %s", resp.Status)
+		}
+		glog.Warningf("%sRetrying %s %s in %v after error: %v", tracePrefix(req.Context()), req.Method, req.URL, delay, err)
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+
+		if req, err = c.rewind(req); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// attempt executes a request once, within the client's timeout. The
+// response body is read before the attempt's context is cancelled, so
+// that callers can still read it.
+func (c *restAPIClient) attempt(req *http.Request) (*http.Response, error) {
+	if c.timeout > 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), c.timeout)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+
+	start := time.Now()
+	resp, err := c.client.Do(req)
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(resp.StatusCode)
+	}
+	metrics.APIRequestDuration.WithLabelValues(endpoint(req.URL.Path), req.Method, status).Observe(time.Since(start).Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response body: %w", err)
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
+
+// idSegments are the path segments that are followed by the ID of a device, group,
+// command or schedule, which endpoint replaces so that requests to the same kind
+// of resource are counted together
+var idSegments = map[string]bool{"devices": true, "groups": true, "commands": true, "skeds": true}
+
+// endpoint returns the path of a request with any IDs in it replaced by "{id}",
+// e.g. /v2/devices/{id}/actions/TurnOn
+func endpoint(urlPath string) string {
+	segments := strings.Split(urlPath, "/")
+	for i := 1; i < len(segments); i++ {
+		if idSegments[segments[i-1]] && segments[i] != "" {
+			segments[i] = "{id}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// reresolve looks up the bridge's address after err,
+// and reports whether the address has changed
+func (c *restAPIClient) reresolve(err error) bool {
+	hostname, resolveErr := c.resolve()
+	if resolveErr != nil {
+		glog.Warningf("Unable to resolve bridge address after error %q: %v", err, resolveErr)
+		return false
+	}
+
+	c.mu.Lock()
+	previous := c.hostname
+	c.hostname = hostname
+	c.mu.Unlock()
+
+	if hostname == previous {
+		return false
+	}
+	glog.Infof("Bridge address changed from %s to %s, retrying request", previous, hostname)
+	return true
+}
+
+// rewind returns a copy of a request, to be sent again
+// to the bridge's current address with the same body
+func (c *restAPIClient) rewind(req *http.Request) (*http.Request, error) {
+	c.mu.Lock()
+	hostname := c.hostname
+	c.mu.Unlock()
+
+	retry := req.Clone(req.Context())
+	retry.URL.Host = hostname
+	retry.Host = hostname
+	if req.GetBody != nil {
+		var err error
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, fmt.Errorf("error copying request body: %w", err)
+		}
+	}
+	return retry, nil
+}
+
+// shouldRetry reports whether a request that failed with err, or
+// got resp, may succeed if retried without repeating its effect
+func shouldRetry(req *http.Request, resp *http.Response, err error) bool {
+	if err != nil {
+		if req.Context().Err() != nil {
+			return false
+		}
+		return neverSent(err) || isIdempotent(req)
+	}
+
+	switch {
+	case isBusy(resp.StatusCode):
+		return true
+	case resp.StatusCode == http.StatusInternalServerError,
+		resp.StatusCode == http.StatusBadGateway,
+		resp.StatusCode == http.StatusGatewayTimeout:
+		return isIdempotent(req)
+	}
+	return false
+}
+
+// nonIdempotentActions are prefixes of actions whose effect
+// depends on the device's current state, e.g. TogglePower
+var nonIdempotentActions = []string{"Toggle", "Increase", "Decrease", "Cycle"}
+
+// isIdempotent reports whether sending a request twice has the same effect as sending it once.
+// Executing an action is idempotent unless it is relative to the device's current state, and
+// transmitting a command isn't, since it may have been learned from a toggle button.
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodDelete, http.MethodPatch:
+		return true
+	case http.MethodPut:
+		parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+		last := parts[len(parts)-1]
+		if last == "tx" {
+			return false
+		}
+		if len(parts) >= 2 && parts[len(parts)-2] == "actions" {
+			for _, prefix := range nonIdempotentActions {
+				if strings.HasPrefix(last, prefix) {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// jitteredBackoff returns a random delay between half and all of
+// backoff, doubled for each retry after the first
+func jitteredBackoff(backoff time.Duration, retry int) time.Duration {
+	d := backoff << (retry - 1)
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// expect2xxResponse returns a StatusError if the bridge didn't respond with 2xx
 func expect2xxResponse(r *http.Response) error {
-	if !(r.StatusCode >= 200 && r.StatusCode < 300) {
-		return fmt.Errorf("expected 2xx response but got: %v", r)
+	if r.StatusCode >= 200 && r.StatusCode < 300 {
+		return nil
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	return &StatusError{
+		Method:     r.Request.Method,
+		URL:        r.Request.URL.String(),
+		StatusCode: r.StatusCode,
+		Body:       strings.TrimSpace(string(body)),
+		idempotent: isIdempotent(r.Request),
 	}
-	return nil
 }
 
 func unmarshalResponseBody(r *http.Response, v interface{}) error {
@@ -1,12 +1,19 @@
 package bondhome
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 const (
@@ -89,7 +96,37 @@ func Test_restAPIClient_executeAction(t *testing.T) {
 	})
 	defer ts.Close()
 
-	err := client.ExecuteAction(deviceID, actionID, expectedArg)
+	err := client.ExecuteAction(context.Background(), deviceID, actionID, expectedArg)
+	if err != nil {
+		t.Errorf("got error: %v", err)
+	}
+
+	expectRequestReceived(t, received)
+}
+
+func Test_restAPIClient_executeAction_addressChanged(t *testing.T) {
+	expectedArg := `{"argument": 3}`
+
+	ts, client, received := setupTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		expectURLPath(t, "/v2/devices/"+deviceID+"/actions/"+actionID, r)
+		defer r.Body.Close()
+		if bodyBytes, err := ioutil.ReadAll(r.Body); err != nil {
+			t.Errorf("error reading request body: %v", err)
+		} else if string(bodyBytes) != expectedArg {
+			t.Errorf("expected request body %q but got %q", expectedArg, string(bodyBytes))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	// Point the client at a server that is no longer listening
+	gone := httptest.NewServer(http.NotFoundHandler())
+	gone.Close()
+	client.hostname = strings.Replace(gone.URL, "http://", "", 1)
+	client.resolve = func() (string, error) {
+		return strings.Replace(ts.URL, "http://", "", 1), nil
+	}
+
+	err := client.ExecuteAction(context.Background(), deviceID, actionID, expectedArg)
 	if err != nil {
 		t.Errorf("got error: %v", err)
 	}
@@ -103,7 +140,7 @@ func Test_restAPIClient_executeAction_serverError(t *testing.T) {
 	})
 	defer ts.Close()
 
-	err := client.ExecuteAction(deviceID, actionID, "")
+	err := client.ExecuteAction(context.Background(), deviceID, actionID, "")
 
 	expectRequestReceived(t, received)
 
@@ -116,6 +153,175 @@ func Test_restAPIClient_executeAction_serverError(t *testing.T) {
 	}
 }
 
+// setupRetryingTestServer returns a client that retries requests to a server
+// which responds with the given statuses in turn, and the number of requests it got
+func setupRetryingTestServer(t *testing.T, statuses ...int) (*restAPIClient, *int32) {
+	t.Helper()
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		i := atomic.AddInt32(&requests, 1) - 1
+		if int(i) >= len(statuses) {
+			t.Errorf("unexpected request %d: %s %s", i+1, r.Method, r.URL)
+			return
+		}
+		w.WriteHeader(statuses[i])
+	}))
+	t.Cleanup(ts.Close)
+
+	client := newRestAPIClient(strings.Replace(ts.URL, "http://", "", 1), token, nil,
+		[]Option{WithRetries(2, time.Millisecond)})
+	client.client = ts.Client()
+	return client, &requests
+}
+
+func Test_restAPIClient_retries(t *testing.T) {
+	tests := []struct {
+		name             string
+		actionID         string
+		statuses         []int
+		expectedRequests int32
+		expectedErr      error
+	}{
+		{"busy then success", "TogglePower", []int{503, 429, 204}, 3, nil},
+		{"busy until out of retries", "SetSpeed", []int{503, 503, 503}, 3, ErrBusy},
+		{"idempotent action after server error", "SetSpeed", []int{500, 204}, 2, nil},
+		{"toggle after server error", "TogglePower", []int{500}, 1, nil},
+		{"not found", "SetSpeed", []int{404}, 1, ErrNotFound},
+		{"unauthorized", "SetSpeed", []int{401}, 1, ErrUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, requests := setupRetryingTestServer(t, tt.statuses...)
+
+			err := client.ExecuteAction(context.Background(), deviceID, tt.actionID, `{"argument": 1}`)
+
+			if *requests != tt.expectedRequests {
+				t.Errorf("expected %d requests but got %d", tt.expectedRequests, *requests)
+			}
+			lastStatus := tt.statuses[len(tt.statuses)-1]
+			switch {
+			case lastStatus < 300 && err != nil:
+				t.Errorf("expected no error but got: %v", err)
+			case lastStatus >= 300 && err == nil:
+				t.Errorf("expected an error but got none")
+			case tt.expectedErr != nil && !errors.Is(err, tt.expectedErr):
+				t.Errorf("expected error %v but got: %v", tt.expectedErr, err)
+			}
+		})
+	}
+}
+
+func Test_restAPIClient_timeout(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	client := newRestAPIClient(strings.Replace(ts.URL, "http://", "", 1), token, nil,
+		[]Option{WithTimeout(10 * time.Millisecond), WithRetries(0, 0)})
+	client.client = ts.Client()
+
+	_, err := client.GetDevice(context.Background(), deviceID)
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the request to time out but got: %v", err)
+	}
+}
+
+func Test_restAPIClient_cancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(WithRequestID(context.Background(), "test-1"))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Shutting down while the request is in flight abandons it, without retrying it
+		cancel()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	client := newRestAPIClient(strings.Replace(ts.URL, "http://", "", 1), token, nil,
+		[]Option{WithRetries(2, time.Hour)})
+	client.client = ts.Client()
+
+	err := client.ExecuteAction(ctx, deviceID, actionID, "{}")
+
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the request to be cancelled but got: %v", err)
+	}
+	if id := RequestID(ctx); id != "test-1" {
+		t.Errorf("expected request ID %q but got %q", "test-1", id)
+	}
+}
+
+func Test_IsRetryable(t *testing.T) {
+	dialErr := &net.OpError{Op: "dial", Err: errors.New("connection refused")}
+	tests := []struct {
+		name      string
+		err       error
+		retryable bool
+	}{
+		{"busy", &StatusError{StatusCode: http.StatusServiceUnavailable}, true},
+		{"too many requests", &StatusError{StatusCode: http.StatusTooManyRequests}, true},
+		{"idempotent server error", &StatusError{StatusCode: http.StatusBadGateway, idempotent: true}, true},
+		{"server error", &StatusError{StatusCode: http.StatusBadGateway}, false},
+		{"not found", &StatusError{StatusCode: http.StatusNotFound, idempotent: true}, false},
+		{"dial error", fmt.Errorf("error executing HTTP request: %w", &RequestError{Err: dialErr}), true},
+		{"idempotent timeout", &RequestError{Err: context.DeadlineExceeded, idempotent: true}, true},
+		{"timeout", &RequestError{Err: context.DeadlineExceeded}, false},
+		{"invalid action", errors.New("action SetSpeed is not supported"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if actual := IsRetryable(tt.err); actual != tt.retryable {
+				t.Errorf("expected IsRetryable(%v) to be %v", tt.err, tt.retryable)
+			}
+		})
+	}
+}
+
+func Test_endpoint(t *testing.T) {
+	tests := map[string]string{
+		"/v2/devices":                               "/v2/devices",
+		"/v2/devices/aabbccdd":                      "/v2/devices/{id}",
+		"/v2/devices/aabbccdd/actions/SetSpeed":     "/v2/devices/{id}/actions/SetSpeed",
+		"/v2/devices/aabbccdd/commands/1234abcd/tx": "/v2/devices/{id}/commands/{id}/tx",
+		"/v2/devices/aabbccdd/skeds/":               "/v2/devices/{id}/skeds/",
+		"/v2/groups/12345678/state":                 "/v2/groups/{id}/state",
+		"/v2/sys/version":                           "/v2/sys/version",
+	}
+	for path, expected := range tests {
+		if actual := endpoint(path); actual != expected {
+			t.Errorf("expected endpoint(%q) to be %q but got %q", path, expected, actual)
+		}
+	}
+}
+
+func Test_isIdempotent(t *testing.T) {
+	tests := []struct {
+		method     string
+		path       string
+		idempotent bool
+	}{
+		{http.MethodGet, "/v2/devices/aabbccdd", true},
+		{http.MethodPut, "/v2/devices/aabbccdd/actions/SetSpeed", true},
+		{http.MethodPut, "/v2/devices/aabbccdd/actions/TurnOff", true},
+		{http.MethodPut, "/v2/devices/aabbccdd/actions/TogglePower", false},
+		{http.MethodPut, "/v2/groups/aabbccdd/actions/IncreaseBrightness", false},
+		{http.MethodPut, "/v2/devices/aabbccdd/commands/1234/tx", false},
+		{http.MethodPatch, "/v2/devices/aabbccdd/state", true},
+		{http.MethodPost, "/v2/devices/aabbccdd/skeds", false},
+		{http.MethodDelete, "/v2/devices/aabbccdd/skeds/1234", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if actual := isIdempotent(req); actual != tt.idempotent {
+				t.Fatalf("expected idempotent=%v but got %v", tt.idempotent, actual)
+			}
+		})
+	}
+}
+
 func Test_restAPIClient_getDeviceIds(t *testing.T) {
 	expectedDeviceIDs := map[string]bool{
 		"deviceID1": true,
@@ -150,7 +356,7 @@ func Test_restAPIClient_getDeviceIds(t *testing.T) {
 	})
 	defer ts.Close()
 
-	actualIDs, err := client.GetDeviceIDs()
+	actualIDs, err := client.GetDeviceIDs(context.Background())
 
 	if err != nil {
 		t.Fatalf("unexpected request error: %v", err)
@@ -175,7 +381,7 @@ func Test_restAPIClient_getDeviceIds_serverError(t *testing.T) {
 	})
 	defer ts.Close()
 
-	_, err := client.GetDeviceIDs()
+	_, err := client.GetDeviceIDs(context.Background())
 
 	expectRequestReceived(t, received)
 
@@ -232,7 +438,7 @@ func Test_restAPIClient_getDevice(t *testing.T) {
 	})
 	defer ts.Close()
 
-	d, err := client.GetDevice(deviceID)
+	d, err := client.GetDevice(context.Background(), deviceID)
 
 	if err != nil {
 		t.Fatalf("unexpected request error: %v", err)
@@ -251,7 +457,7 @@ func Test_restAPIClient_getDevice_serverError(t *testing.T) {
 	})
 	defer ts.Close()
 
-	_, err := client.GetDevice(deviceID)
+	_, err := client.GetDevice(context.Background(), deviceID)
 
 	expectRequestReceived(t, received)
 
@@ -263,3 +469,369 @@ func Test_restAPIClient_getDevice_serverError(t *testing.T) {
 		t.Fatalf("got different error than expected: %v", err)
 	}
 }
+
+func Test_restAPIClient_getDeviceState(t *testing.T) {
+	const responseJSON = `{"power":1,"speed":3,"light":0,"_":"84cd8a43"}`
+
+	ts, client, received := setupTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		expectToken(t, r)
+		expectMethod(t, http.MethodGet, r)
+		expectURLPath(t, "/v2/devices/"+deviceID+"/state", r)
+
+		w.Write([]byte(responseJSON))
+	})
+	defer ts.Close()
+
+	state, err := client.GetDeviceState(context.Background(), deviceID)
+
+	if err != nil {
+		t.Fatalf("unexpected request error: %v", err)
+	}
+
+	expectRequestReceived(t, received)
+
+	if string(state) != responseJSON {
+		t.Fatalf("expected state %q but was %q", responseJSON, string(state))
+	}
+}
+
+func Test_restAPIClient_getDeviceState_serverError(t *testing.T) {
+	ts, client, received := setupTestServer(t, func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(w, "expected error", 503)
+	})
+	defer ts.Close()
+
+	_, err := client.GetDeviceState(context.Background(), deviceID)
+
+	expectRequestReceived(t, received)
+
+	if err == nil {
+		t.Fatalf("expected an error but got none")
+	}
+
+	if !strings.Contains(err.Error(), "expected 2xx response but got") {
+		t.Fatalf("got different error than expected: %v", err)
+	}
+}
+
+func Test_restAPIClient_updateDeviceState(t *testing.T) {
+	const expectedBody = `{"power": 0}`
+
+	ts, client, received := setupTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		expectToken(t, r)
+		expectMethod(t, http.MethodPatch, r)
+		expectURLPath(t, "/v2/devices/"+deviceID+"/state", r)
+		defer r.Body.Close()
+		if bodyBytes, err := ioutil.ReadAll(r.Body); err != nil {
+			t.Errorf("error reading request body: %v", err)
+		} else if string(bodyBytes) != expectedBody {
+			t.Errorf("expected request body %q but got %q", expectedBody, string(bodyBytes))
+		}
+		w.Write([]byte(`{"power": 0}`))
+	})
+	defer ts.Close()
+
+	if err := client.UpdateDeviceState(context.Background(), deviceID, expectedBody); err != nil {
+		t.Fatalf("unexpected request error: %v", err)
+	}
+
+	expectRequestReceived(t, received)
+}
+
+func Test_restAPIClient_getDeviceProperties(t *testing.T) {
+	ts, client, received := setupTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		expectToken(t, r)
+		expectMethod(t, http.MethodGet, r)
+		expectURLPath(t, "/v2/devices/"+deviceID+"/properties", r)
+
+		w.Write([]byte(`{"addr":"10101","freq":434300,"bps":3000,"zero_gap":30,"trust_state":false,"max_speed":6,"_":"84cd8a43"}`))
+	})
+	defer ts.Close()
+
+	properties, err := client.GetDeviceProperties(context.Background(), deviceID)
+
+	if err != nil {
+		t.Fatalf("unexpected request error: %v", err)
+	}
+
+	expectRequestReceived(t, received)
+
+	trustState := false
+	expected := &DeviceProperties{Addr: "10101", Freq: 434300, BPS: 3000, ZeroGap: 30, TrustState: &trustState, MaxSpeed: 6}
+	if !reflect.DeepEqual(properties, expected) {
+		t.Fatalf("expected properties %+v but was %+v", expected, properties)
+	}
+}
+
+func Test_restAPIClient_patchDeviceProperties(t *testing.T) {
+	const expectedBody = `{"trust_state":true,"max_speed":4}`
+
+	ts, client, received := setupTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		expectToken(t, r)
+		expectMethod(t, http.MethodPatch, r)
+		expectURLPath(t, "/v2/devices/"+deviceID+"/properties", r)
+		defer r.Body.Close()
+		if bodyBytes, err := ioutil.ReadAll(r.Body); err != nil {
+			t.Errorf("error reading request body: %v", err)
+		} else if string(bodyBytes) != expectedBody {
+			t.Errorf("expected request body %q but got %q", expectedBody, string(bodyBytes))
+		}
+		w.Write([]byte(`{"trust_state":true,"max_speed":4}`))
+	})
+	defer ts.Close()
+
+	trustState := true
+	err := client.PatchDeviceProperties(context.Background(), deviceID, &DeviceProperties{TrustState: &trustState, MaxSpeed: 4})
+	if err != nil {
+		t.Fatalf("unexpected request error: %v", err)
+	}
+
+	expectRequestReceived(t, received)
+}
+
+func Test_restAPIClient_getCommandIDs(t *testing.T) {
+	ts, client, received := setupTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		expectToken(t, r)
+		expectMethod(t, http.MethodGet, r)
+		expectURLPath(t, "/v2/devices/"+deviceID+"/commands", r)
+
+		w.Write([]byte(`{"_": "7fc1e84b", "49a6d5": {"_": "9a5e1136"}}`))
+	})
+	defer ts.Close()
+
+	ids, err := client.GetCommandIDs(context.Background(), deviceID)
+
+	if err != nil {
+		t.Fatalf("unexpected request error: %v", err)
+	}
+
+	expectRequestReceived(t, received)
+
+	if !reflect.DeepEqual(ids, []string{"49a6d5"}) {
+		t.Fatalf("expected command IDs [49a6d5] but was %v", ids)
+	}
+}
+
+func Test_restAPIClient_getCommand(t *testing.T) {
+	ts, client, received := setupTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		expectToken(t, r)
+		expectMethod(t, http.MethodGet, r)
+		expectURLPath(t, "/v2/devices/"+deviceID+"/commands/49a6d5", r)
+
+		w.Write([]byte(`{"name": "Dim Up", "icon": "light", "category_id": 2, "action": "IncreaseBrightness", "argument": null, "_": "9a5e1136"}`))
+	})
+	defer ts.Close()
+
+	command, err := client.GetCommand(context.Background(), deviceID, "49a6d5")
+
+	if err != nil {
+		t.Fatalf("unexpected request error: %v", err)
+	}
+
+	expectRequestReceived(t, received)
+
+	expected := &Command{Name: "Dim Up", Icon: "light", CategoryID: 2, Action: "IncreaseBrightness", Argument: json.RawMessage("null")}
+	if !reflect.DeepEqual(command, expected) {
+		t.Fatalf("expected command %+v but was %+v", expected, command)
+	}
+}
+
+func Test_restAPIClient_executeCommand(t *testing.T) {
+	ts, client, received := setupTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		expectToken(t, r)
+		expectMethod(t, http.MethodPut, r)
+		expectURLPath(t, "/v2/devices/"+deviceID+"/commands/49a6d5/tx", r)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	defer ts.Close()
+
+	if err := client.ExecuteCommand(context.Background(), deviceID, "49a6d5"); err != nil {
+		t.Fatalf("unexpected request error: %v", err)
+	}
+
+	expectRequestReceived(t, received)
+}
+
+func Test_restAPIClient_getGroup(t *testing.T) {
+	ts, client, received := setupTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		expectToken(t, r)
+		expectMethod(t, http.MethodGet, r)
+		expectURLPath(t, "/v2/groups/groupID1", r)
+
+		w.Write([]byte(`{"name": "All Fans", "devices": ["aabbccdd", "11223344"], "types": ["CF"], "locations": ["Bedroom", "Office"], "actions": ["TurnOn", "TurnOff"], "_": "7fc1e84b"}`))
+	})
+	defer ts.Close()
+
+	group, err := client.GetGroup(context.Background(), "groupID1")
+
+	if err != nil {
+		t.Fatalf("unexpected request error: %v", err)
+	}
+
+	expectRequestReceived(t, received)
+
+	expected := &Group{
+		Name:      "All Fans",
+		Devices:   []string{"aabbccdd", "11223344"},
+		Types:     []string{"CF"},
+		Locations: []string{"Bedroom", "Office"},
+		Actions:   []string{"TurnOn", "TurnOff"},
+	}
+	if !reflect.DeepEqual(group, expected) {
+		t.Fatalf("expected group %+v but was %+v", expected, group)
+	}
+}
+
+func Test_restAPIClient_executeGroupAction(t *testing.T) {
+	const expectedArg = `{"argument": 2}`
+
+	ts, client, received := setupTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		expectToken(t, r)
+		expectMethod(t, http.MethodPut, r)
+		expectURLPath(t, "/v2/groups/groupID1/actions/SetSpeed", r)
+		defer r.Body.Close()
+		if bodyBytes, err := ioutil.ReadAll(r.Body); err != nil {
+			t.Errorf("error reading request body: %v", err)
+		} else if string(bodyBytes) != expectedArg {
+			t.Errorf("expected request body %q but got %q", expectedArg, string(bodyBytes))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	defer ts.Close()
+
+	if err := client.ExecuteGroupAction(context.Background(), "groupID1", "SetSpeed", expectedArg); err != nil {
+		t.Fatalf("unexpected request error: %v", err)
+	}
+
+	expectRequestReceived(t, received)
+}
+
+func Test_restAPIClient_getGroupState(t *testing.T) {
+	const responseJSON = `{"power":1,"speed":2,"_":"84cd8a43"}`
+
+	ts, client, received := setupTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		expectToken(t, r)
+		expectMethod(t, http.MethodGet, r)
+		expectURLPath(t, "/v2/groups/groupID1/state", r)
+
+		w.Write([]byte(responseJSON))
+	})
+	defer ts.Close()
+
+	state, err := client.GetGroupState(context.Background(), "groupID1")
+
+	if err != nil {
+		t.Fatalf("unexpected request error: %v", err)
+	}
+
+	expectRequestReceived(t, received)
+
+	if string(state) != responseJSON {
+		t.Fatalf("expected state %q but was %q", responseJSON, string(state))
+	}
+}
+
+func Test_restAPIClient_getSked(t *testing.T) {
+	ts, client, received := setupTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		expectToken(t, r)
+		expectMethod(t, http.MethodGet, r)
+		expectURLPath(t, "/v2/devices/"+deviceID+"/skeds/sked1", r)
+
+		w.Write([]byte(`{"action": "SetSpeed", "argument": 2, "weekdays": 62, "mark": "sunset", "minutes": -30, "enabled": true, "_": "7fc1e84b"}`))
+	})
+	defer ts.Close()
+
+	sked, err := client.GetSked(context.Background(), deviceID, "sked1")
+
+	if err != nil {
+		t.Fatalf("unexpected request error: %v", err)
+	}
+
+	expectRequestReceived(t, received)
+
+	weekdays, minutes, enabled := 62, -30, true
+	expected := &Sked{
+		ID:       "sked1",
+		Action:   "SetSpeed",
+		Argument: json.RawMessage("2"),
+		Weekdays: &weekdays,
+		Mark:     "sunset",
+		Minutes:  &minutes,
+		Enabled:  &enabled,
+	}
+	if !reflect.DeepEqual(sked, expected) {
+		t.Fatalf("expected schedule %+v but was %+v", expected, sked)
+	}
+}
+
+func Test_restAPIClient_createSked(t *testing.T) {
+	const expectedBody = `{"action":"TurnOn","weekdays":127,"mark":"midnight","minutes":420}`
+
+	ts, client, received := setupTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		expectToken(t, r)
+		expectMethod(t, http.MethodPost, r)
+		expectURLPath(t, "/v2/devices/"+deviceID+"/skeds", r)
+		defer r.Body.Close()
+		if bodyBytes, err := ioutil.ReadAll(r.Body); err != nil {
+			t.Errorf("error reading request body: %v", err)
+		} else if string(bodyBytes) != expectedBody {
+			t.Errorf("expected request body %q but got %q", expectedBody, string(bodyBytes))
+		}
+		w.Write([]byte(`{"__id": "sked2", "action": "TurnOn", "argument": null, "weekdays": 127, "mark": "midnight", "minutes": 420, "enabled": true, "_": "7fc1e84b"}`))
+	})
+	defer ts.Close()
+
+	weekdays, minutes := 127, 420
+	sked, err := client.CreateSked(context.Background(), deviceID, &Sked{Action: "TurnOn", Weekdays: &weekdays, Mark: "midnight", Minutes: &minutes})
+
+	if err != nil {
+		t.Fatalf("unexpected request error: %v", err)
+	}
+
+	expectRequestReceived(t, received)
+
+	if sked.ID != "sked2" {
+		t.Fatalf("expected schedule ID %q but was %q", "sked2", sked.ID)
+	}
+}
+
+func Test_restAPIClient_patchSked(t *testing.T) {
+	const expectedBody = `{"enabled":false}`
+
+	ts, client, received := setupTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		expectToken(t, r)
+		expectMethod(t, http.MethodPatch, r)
+		expectURLPath(t, "/v2/devices/"+deviceID+"/skeds/sked1", r)
+		defer r.Body.Close()
+		if bodyBytes, err := ioutil.ReadAll(r.Body); err != nil {
+			t.Errorf("error reading request body: %v", err)
+		} else if string(bodyBytes) != expectedBody {
+			t.Errorf("expected request body %q but got %q", expectedBody, string(bodyBytes))
+		}
+		w.Write([]byte(`{"enabled": false}`))
+	})
+	defer ts.Close()
+
+	enabled := false
+	if err := client.PatchSked(context.Background(), deviceID, "sked1", &Sked{ID: "sked1", Enabled: &enabled}); err != nil {
+		t.Fatalf("unexpected request error: %v", err)
+	}
+
+	expectRequestReceived(t, received)
+}
+
+func Test_restAPIClient_deleteSked(t *testing.T) {
+	ts, client, received := setupTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		expectToken(t, r)
+		expectMethod(t, http.MethodDelete, r)
+		expectURLPath(t, "/v2/devices/"+deviceID+"/skeds/sked1", r)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	defer ts.Close()
+
+	if err := client.DeleteSked(context.Background(), deviceID, "sked1"); err != nil {
+		t.Fatalf("unexpected request error: %v", err)
+	}
+
+	expectRequestReceived(t, received)
+}
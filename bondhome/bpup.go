@@ -1,14 +1,36 @@
 package bondhome
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
+	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang/glog"
+
+	"github.com/ssmall/bondhome-mqtt/metrics"
+)
+
+const (
+	keepAliveInterval = 60 * time.Second
+	handshakeTimeout  = 5 * time.Second
+
+	// silenceTimeout is how long the client waits without receiving anything
+	// from the bridge before considering the connection lost. The bridge
+	// replies to every keep-alive, so this allows for a couple of lost packets.
+	silenceTimeout = 3 * keepAliveInterval
+
+	minReconnectBackoff = 1 * time.Second
+	maxReconnectBackoff = 60 * time.Second
+
+	// bpupPort is the UDP port that bridges listen for BPUP clients on
+	bpupPort = "30007"
 )
 
 // Update represents an update message from the Bond Bridge
@@ -27,6 +49,16 @@ type Update struct {
 // Timeout is returned when an operation times out
 type Timeout error
 
+// ConnectionEvent is emitted by a PushClient whenever its
+// connection to the bridge is established or lost
+type ConnectionEvent struct {
+	// Connected is true if a handshake with the bridge succeeded
+	// and false if the connection was lost
+	Connected bool
+	// Err is the reason that the connection was lost, if any
+	Err error
+}
+
 // PushClient is an interface for receiving messages
 // pushed from a Bond Home bridge
 type PushClient interface {
@@ -42,115 +74,370 @@ type PushClient interface {
 	// Receive waits for an update from the server, up to
 	// a specified timeout. If the receive times out,
 	// the returned error will be of type Timeout.
+	// While the client is reconnecting to the bridge, Receive
+	// waits for the connection to be re-established.
 	Receive(timeout time.Duration) (*Update, error)
+
+	// BondID returns the ID that the bridge identified itself
+	// with during the handshake, or "" if StartListening
+	// has not completed successfully
+	BondID() string
+
+	// ConnectionEvents returns a channel that receives an event each
+	// time the connection to the bridge is established or lost. After
+	// StartListening returns, the client automatically reconnects
+	// whenever the connection is lost.
+	ConnectionEvents() <-chan ConnectionEvent
 }
 
 type bpupClient struct {
 	ctx    context.Context
 	cancel context.CancelFunc
-	conn   *net.UDPConn
+	addr   *net.UDPAddr
+	events chan ConnectionEvent
+	// lost signals the keep-alive loop that the connection needs to be re-established
+	lost chan error
+	// resolve looks up the bridge's address when reconnecting, if set
+	resolve Resolver
+
+	mu           sync.Mutex
+	conn         *net.UDPConn
+	bondID       string
+	connected    bool
+	ready        chan struct{} // closed once connected
+	lastReceived time.Time
 }
 
 // NewClient creates a new PushClient that receives updates
 // from the bridge at the given address
 func NewClient(ctx context.Context, bridgeAddress string) (PushClient, error) {
+	return newClient(ctx, bridgeAddress)
+}
+
+// NewResolvingClient creates a new PushClient that receives updates from a
+// bridge whose address is looked up with resolve. The address is looked up
+// again each time the client reconnects, in case it has changed.
+func NewResolvingClient(ctx context.Context, resolve Resolver) (PushClient, error) {
+	hostname, err := resolve()
+	if err != nil {
+		return nil, fmt.Errorf("error resolving bridge address: %w", err)
+	}
+	c, err := newClient(ctx, net.JoinHostPort(hostname, bpupPort))
+	if err != nil {
+		return nil, err
+	}
+	c.resolve = resolve
+	return c, nil
+}
+
+func newClient(ctx context.Context, bridgeAddress string) (*bpupClient, error) {
 	addr, err := net.ResolveUDPAddr("udp", bridgeAddress)
 	if err != nil {
 		return nil, fmt.Errorf("error resolving bridgeAddress %q: %w", bridgeAddress, err)
 	}
 
+	conn, err := dial(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	return &bpupClient{
+		ctx:    ctx,
+		cancel: cancel,
+		addr:   addr,
+		events: make(chan ConnectionEvent, 16),
+		lost:   make(chan error, 1),
+		conn:   conn,
+		ready:  make(chan struct{}),
+	}, nil
+}
+
+func dial(addr *net.UDPAddr) (*net.UDPConn, error) {
 	conn, err := net.DialUDP("udp", nil, addr)
 	if err != nil {
 		return nil, fmt.Errorf("error opening connection: %w", err)
 	}
 
 	glog.Infoln("Opened UDP connection to", addr, "listening at", conn.LocalAddr())
-	ctx, cancel := context.WithCancel(ctx)
-
-	return &bpupClient{ctx, cancel, conn}, nil
+	return conn, nil
 }
 
 // StartListening blocks on the initial handshake with the server
 // (described at http://docs-local.appbond.com/#section/Bond-Push-UDP-Protocol-(BPUP))
-// and sets up a goroutine to send regular keep-alive signals to the bridge
+// and sets up a goroutine to send regular keep-alive signals to the bridge,
+// reconnecting if the bridge stops responding
 func (c *bpupClient) StartListening() error {
-	_, err := c.conn.Write([]byte("\n"))
+	bondID, err := handshake(c.conn)
+	if err != nil {
+		return err
+	}
+	if !c.setConnected(c.conn, bondID) {
+		return fmt.Errorf("client was stopped during the handshake: %w", c.ctx.Err())
+	}
+
+	go c.keepAlive()
+
+	return nil
+}
+
+func handshake(conn *net.UDPConn) (string, error) {
+	_, err := conn.Write([]byte("\n"))
 	if err != nil {
-		return fmt.Errorf("error sending initial message to server: %w", err)
+		return "", fmt.Errorf("error sending initial message to server: %w", err)
 	}
 
 	buf := make([]byte, 256)
-	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
-	n, _, err := c.conn.ReadFrom(buf)
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	n, _, err := conn.ReadFrom(buf)
 	if err != nil {
-		return fmt.Errorf("error reading handshake response from server: %w", err)
+		return "", fmt.Errorf("error reading handshake response from server: %w", err)
 	}
 	glog.Infoln("Received handshake response from server:", string(buf[:n]))
 
-	go func() {
-		for {
-			select {
-			case <-time.After(60 * time.Second):
-				ctx, cancel := context.WithTimeout(c.ctx, 120*time.Second)
-				sendKeepAlive(ctx, c.conn, 1*time.Second, 0)
-				cancel()
-			case <-c.ctx.Done():
-				return
-			}
-		}
-	}()
-
-	return nil
+	response := &Update{}
+	// Use a decoder so that any trailing data after the JSON object is ignored
+	if err := json.NewDecoder(bytes.NewReader(buf[:n])).Decode(response); err != nil {
+		return "", fmt.Errorf("error unmarshaling handshake response %q: %w", string(buf[:n]), err)
+	}
+	return response.BondID, nil
 }
 
 func (c *bpupClient) StopListening() error {
-	defer c.cancel()
+	// Cancel before taking the lock, so that a reconnect that completes
+	// after this closes its connection instead of keeping it
+	c.cancel()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// The connection is already closed if it was lost while reconnecting
 	err := c.conn.Close()
-	if err != nil {
+	if err != nil && !errors.Is(err, net.ErrClosed) {
 		return fmt.Errorf("error closing connection: %w", err)
 	}
 	return nil
 }
 
+func (c *bpupClient) BondID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.bondID
+}
+
+func (c *bpupClient) ConnectionEvents() <-chan ConnectionEvent {
+	return c.events
+}
+
 func (c *bpupClient) Receive(timeout time.Duration) (*Update, error) {
-	c.conn.SetReadDeadline(time.Now().Add(timeout))
+	deadline := time.Now().Add(timeout)
+	conn, err := c.waitForConnection(deadline)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetReadDeadline(deadline)
 	buf := make([]byte, 512) // 512B message buffer
-	n, err := c.conn.Read(buf)
+	n, err := conn.Read(buf)
 	if err != nil {
 		if e, ok := err.(net.Error); ok && e.Timeout() {
 			return nil, Timeout(e)
 		}
+		c.connectionLost(conn, err)
 		return nil, err
 	}
+	c.mu.Lock()
+	c.lastReceived = time.Now()
+	bondID := c.bondID
+	c.mu.Unlock()
+	metrics.BPUPPacketsReceived.WithLabelValues(bondID).Inc()
+
 	glog.V(1).Infof("Received UDP message from server: %q", string(buf[:n]))
 	trimmed := strings.TrimSpace(string(buf[:n]))
 	update := &Update{}
 	err = json.Unmarshal([]byte(trimmed), update)
 	if err != nil {
+		metrics.BPUPPacketsFailed.WithLabelValues(bondID).Inc()
 		return nil, fmt.Errorf("error unmarshaling %q: %w", trimmed, err)
 	}
+	metrics.BPUPPacketsParsed.WithLabelValues(bondID, update.Topic).Inc()
 	return update, nil
 }
 
-func sendKeepAlive(ctx context.Context, conn *net.UDPConn, backoff time.Duration, elapsed time.Duration) {
-	defer func() {
-		if r := recover(); r != nil {
-			glog.Warningf("Retrying failed keep-alive after %s; failure was: %v\n", backoff, r)
-			select {
-			case <-time.After(backoff):
-				sendKeepAlive(ctx, conn, 2*backoff, elapsed+backoff)
-			case <-ctx.Done():
-				if ctx.Err() == context.DeadlineExceeded {
-					glog.Errorf("Not retrying failed keep-alive since %s have elapsed", elapsed)
-					panic(r)
-				}
-				glog.Warning("Canceling keep-alive retry loop")
-				return
+// waitForConnection returns the current connection, waiting
+// up to the deadline for it to be re-established if necessary
+func (c *bpupClient) waitForConnection(deadline time.Time) (*net.UDPConn, error) {
+	c.mu.Lock()
+	conn, connected, ready := c.conn, c.connected, c.ready
+	c.mu.Unlock()
+
+	if connected {
+		return conn, nil
+	}
+
+	select {
+	case <-ready:
+		return c.waitForConnection(deadline)
+	case <-time.After(time.Until(deadline)):
+		return nil, Timeout(os.ErrDeadlineExceeded)
+	case <-c.ctx.Done():
+		return nil, c.ctx.Err()
+	}
+}
+
+// setConnected makes conn the current connection, unless the client
+// has been stopped, in which case it closes conn and returns false
+func (c *bpupClient) setConnected(conn *net.UDPConn, bondID string) bool {
+	c.mu.Lock()
+	if c.ctx.Err() != nil {
+		c.mu.Unlock()
+		conn.Close()
+		return false
+	}
+	c.conn = conn
+	if bondID != "" {
+		c.bondID = bondID
+	}
+	c.connected = true
+	c.lastReceived = time.Now()
+	close(c.ready)
+	c.mu.Unlock()
+
+	c.emit(ConnectionEvent{Connected: true})
+	return true
+}
+
+// connectionLost signals that the given connection has failed,
+// unless it has already been replaced
+func (c *bpupClient) connectionLost(conn *net.UDPConn, err error) {
+	c.mu.Lock()
+	current := c.connected && c.conn == conn
+	c.mu.Unlock()
+
+	if !current {
+		return
+	}
+
+	select {
+	case c.lost <- err:
+	default: // a reconnect is already pending
+	}
+}
+
+func (c *bpupClient) emit(e ConnectionEvent) {
+	select {
+	case c.events <- e:
+	default:
+		glog.Warningf("Dropping connection event %+v since nobody is receiving them", e)
+	}
+}
+
+// keepAlive regularly sends keep-alive signals to the bridge,
+// reconnecting whenever the connection is lost
+func (c *bpupClient) keepAlive() {
+	ticker := time.NewTicker(keepAliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.sendKeepAlive(); err != nil {
+				c.reconnect(err)
 			}
+		case err := <-c.lost:
+			c.reconnect(err)
+		case <-c.ctx.Done():
+			return
 		}
-	}()
+	}
+}
+
+func (c *bpupClient) sendKeepAlive() error {
+	c.mu.Lock()
+	conn, lastReceived := c.conn, c.lastReceived
+	c.mu.Unlock()
+
+	if silence := time.Since(lastReceived); silence > silenceTimeout {
+		return fmt.Errorf("nothing received from bridge in %s", silence.Round(time.Second))
+	}
+
+	glog.V(2).Infoln("Sending keep-alive to", c.addr)
 	_, err := conn.Write([]byte("\n"))
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("error sending keep-alive: %w", err)
+	}
+	return nil
+}
+
+// reconnect reopens the connection to the bridge and redoes the handshake,
+// backing off exponentially until it succeeds or the client is stopped
+func (c *bpupClient) reconnect(cause error) {
+	glog.Warningf("Lost connection to Bond bridge @ %s: %v", c.addr, cause)
+
+	c.mu.Lock()
+	c.connected = false
+	c.ready = make(chan struct{})
+	c.conn.Close()
+	c.mu.Unlock()
+
+	c.emit(ConnectionEvent{Connected: false, Err: cause})
+
+	backoff := minReconnectBackoff
+	for {
+		metrics.BPUPReconnectAttempts.WithLabelValues(c.BondID()).Inc()
+		if c.resolve != nil {
+			c.reresolve()
+		}
+
+		conn, err := dial(c.addr)
+		if err == nil {
+			var bondID string
+			bondID, err = handshake(conn)
+			if err == nil {
+				if !c.setConnected(conn, bondID) {
+					// The client was stopped during the handshake
+					return
+				}
+				glog.Infoln("Reconnected to Bond bridge @", c.addr)
+				break
+			}
+			conn.Close()
+		}
+
+		glog.Warningf("Reconnecting to Bond bridge @ %s failed, retrying in %s: %v", c.addr, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-c.ctx.Done():
+			return
+		}
+
+		backoff *= 2
+		if backoff > maxReconnectBackoff {
+			backoff = maxReconnectBackoff
+		}
+	}
+
+	// Discard any failure reported against the old connection
+	select {
+	case <-c.lost:
+	default:
+	}
+}
+
+// reresolve looks up the bridge's address again, keeping
+// the previous one if the lookup fails
+func (c *bpupClient) reresolve() {
+	hostname, err := c.resolve()
+	if err != nil {
+		glog.Warningf("Unable to resolve address of Bond bridge, trying %s: %v", c.addr, err)
+		return
+	}
+	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(hostname, bpupPort))
+	if err != nil {
+		glog.Warningf("Unable to resolve address of Bond bridge, trying %s: %v", c.addr, err)
+		return
+	}
+	if addr.String() != c.addr.String() {
+		glog.Infof("Bond bridge address changed from %s to %s", c.addr, addr)
+		c.addr = addr
 	}
 }
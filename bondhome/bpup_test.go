@@ -4,6 +4,7 @@ package bondhome
 
 import (
 	"context"
+	"errors"
 	"net"
 	"testing"
 	"time"
@@ -177,6 +178,10 @@ func Test_StartListening(t *testing.T) {
 	}
 	defer c.StopListening()
 
+	if c.BondID() != "ZZBL12345" {
+		t.Errorf("Expected Bond ID from handshake to be %q but was %q", "ZZBL12345", c.BondID())
+	}
+
 	select {
 	case msg := <-received:
 		if msg != "\n" {
@@ -198,7 +203,7 @@ func Test_StartListening(t *testing.T) {
 
 // takes at least 90s to run
 func Test_StartListening_keepAliveError(t *testing.T) {
-	t.Skip("Un-skip this test and look at the logs to see the keep-alive retry mechanism working")
+	t.Skip("Un-skip this test and look at the logs to see the keep-alive reconnect mechanism working")
 	ctx := context.Background()
 	srv := startTestServerWithHandshake(ctx, t, func(msg string) *string {
 		return nil
@@ -224,11 +229,64 @@ func Test_StartListening_keepAliveError(t *testing.T) {
 		t.Fatal("Couldn't close connection:", err)
 	}
 
-	// Wait long enough for some retries to trigger but not long enough
-	// for it to totally time out and panic
+	// Wait long enough for the failed keep-alive to trigger a reconnect
 	time.Sleep(90 * time.Second)
 }
 
+func Test_Receive_reconnect(t *testing.T) {
+	handshakeResponse := `{"B":"ZZBL12345"}`
+	ctx := context.Background()
+
+	srv := startTestServer(ctx, t, func(msg string) *string {
+		return &handshakeResponse
+	})
+	defer srv.Stop()
+
+	c, err := NewClient(ctx, srv.Address())
+	if err != nil {
+		t.Fatal("Error creating client:", err)
+	}
+
+	err = c.StartListening()
+	if err != nil {
+		t.Fatal("Error calling StartListening:", err)
+	}
+	defer c.StopListening()
+
+	expectConnectionEvent(t, c, true)
+
+	// Break the connection out from under the client
+	b := c.(*bpupClient)
+	b.mu.Lock()
+	b.conn.Close()
+	b.mu.Unlock()
+
+	if _, err := c.Receive(1 * time.Second); err == nil {
+		t.Fatal("Expected an error receiving from closed connection")
+	}
+
+	expectConnectionEvent(t, c, false)
+	expectConnectionEvent(t, c, true)
+
+	if _, err := c.Receive(100 * time.Millisecond); err != nil {
+		if _, ok := err.(net.Error); !ok {
+			t.Fatal("Expected receive after reconnecting to time out but got:", err)
+		}
+	}
+}
+
+func expectConnectionEvent(t *testing.T, c PushClient, connected bool) {
+	t.Helper()
+	select {
+	case e := <-c.ConnectionEvents():
+		if e.Connected != connected {
+			t.Fatalf("Expected connection event with Connected=%v but got %+v", connected, e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected connection event with Connected=%v within 5 seconds", connected)
+	}
+}
+
 func Test_Receive(t *testing.T) {
 	updateMsg := "{\"B\":\"ZZBL12345\",\"t\":\"devices/aabbccdd/state\",\"i\":\"00112233bbeeeeff\",\"s\":200,\"m\":0,\"f\":255,\"b\":{\"_\":\"ab9284ef\",\"power\":1,\"speed\":2}}\n"
 
@@ -301,3 +359,52 @@ func sendMsgToClient(t *testing.T, c *bpupClient, msg string) {
 		t.Fatal("Erroring sending message:", err)
 	}
 }
+
+func Test_StopListening_duringReconnect(t *testing.T) {
+	handshakeResponse := `{"B":"ZZBL12345"}`
+	ctx := context.Background()
+
+	srv := startTestServer(ctx, t, func(msg string) *string {
+		return &handshakeResponse
+	})
+	defer srv.Stop()
+
+	c, err := NewClient(ctx, srv.Address())
+	if err != nil {
+		t.Fatal("Error creating client:", err)
+	}
+
+	err = c.StartListening()
+	if err != nil {
+		t.Fatal("Error calling StartListening:", err)
+	}
+	expectConnectionEvent(t, c, true)
+
+	// Close the connection as reconnect does when the connection is lost
+	b := c.(*bpupClient)
+	b.mu.Lock()
+	b.conn.Close()
+	b.mu.Unlock()
+
+	if err := c.StopListening(); err != nil {
+		t.Fatal("Expected no error stopping a client whose connection was lost but got:", err)
+	}
+
+	// A reconnect that completes after the client was stopped
+	conn, err := dial(b.addr)
+	if err != nil {
+		t.Fatal("Error opening connection:", err)
+	}
+	if b.setConnected(conn, "ZZBL12345") {
+		t.Fatal("Expected the connection not to be used after the client was stopped")
+	}
+	if _, err := conn.Write([]byte("\n")); !errors.Is(err, net.ErrClosed) {
+		t.Fatal("Expected the connection to be closed but writing to it got:", err)
+	}
+
+	select {
+	case e := <-c.ConnectionEvents():
+		t.Fatalf("Expected no connection event after the client was stopped but got %+v", e)
+	default:
+	}
+}
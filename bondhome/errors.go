@@ -0,0 +1,100 @@
+package bondhome
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+var (
+	// ErrUnauthorized means the bridge rejected the token of a request
+	ErrUnauthorized = errors.New("unauthorized")
+	// ErrNotFound means the device, group, command or schedule of a request doesn't exist
+	ErrNotFound = errors.New("not found")
+	// ErrBusy means the bridge was too busy to handle a request, which may be retried later
+	ErrBusy = errors.New("bridge busy")
+)
+
+// StatusError is returned when the bridge responds to a request with a status other
+// than 2xx. Use errors.Is to check whether it is ErrUnauthorized, ErrNotFound or ErrBusy.
+type StatusError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	// Body is the response body, which usually explains the error
+	Body string
+
+	// idempotent is whether sending the request again can't repeat its effect
+	idempotent bool
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("expected 2xx response but got %d %s for %s %s: %s",
+		e.StatusCode, http.StatusText(e.StatusCode), e.Method, e.URL, e.Body)
+}
+
+// Is reports whether the status of the response corresponds to target
+func (e *StatusError) Is(target error) bool {
+	switch target {
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrBusy:
+		return isBusy(e.StatusCode)
+	}
+	return false
+}
+
+// RequestError is returned when a request to the bridge fails without a response,
+// e.g. because the bridge couldn't be reached or the request timed out
+type RequestError struct {
+	Method string
+	URL    string
+	Err    error
+
+	// idempotent is whether sending the request again can't repeat its effect
+	idempotent bool
+}
+
+func (e *RequestError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+// IsRetryable reports whether a request that failed with err may succeed if it is
+// sent again, without risk of repeating its effect on a device: either the request
+// never reached the bridge, because it couldn't be reached or turned the request
+// away as busy, or the request failed in a way that may not recur, e.g. with a
+// server error or a timeout, and sending it twice has the same effect as once
+func IsRetryable(err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		if isBusy(statusErr.StatusCode) {
+			return true
+		}
+		return statusErr.StatusCode >= 500 && statusErr.idempotent
+	}
+	var requestErr *RequestError
+	if errors.As(err, &requestErr) {
+		return neverSent(err) || requestErr.idempotent
+	}
+	return false
+}
+
+// neverSent reports whether a request failed because the connection
+// to the bridge couldn't be opened, so it never reached the bridge
+func neverSent(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// isBusy reports whether a status means the bridge
+// turned a request away without acting on it
+func isBusy(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode == http.StatusServiceUnavailable
+}
@@ -0,0 +1,57 @@
+package bondhome
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// Version represents information about the bridge and its firmware
+// retrieved via the following API request: http://docs-local.appbond.com/#tag/Version/paths/~1v2~1sys~1version/get
+type Version struct {
+	Target          string `json:"target"`
+	FirmwareVersion string `json:"fw_ver"`
+	FirmwareDate    string `json:"fw_date"`
+	// Uptime is the number of seconds since the bridge booted
+	Uptime int64  `json:"uptime_s"`
+	Make   string `json:"make"`
+	Model  string `json:"model"`
+	BondID string `json:"bondid"`
+	API    int    `json:"api"`
+}
+
+// WiFiStatus represents the bridge's connection to the Wi-Fi network
+// retrieved via the following API request: http://docs-local.appbond.com/#tag/Wi-Fi/paths/~1v2~1sys~1wifi~1sta/get
+type WiFiStatus struct {
+	SSID string `json:"ssid"`
+	IP   string `json:"ip"`
+	// RSSI is the signal strength, in dBm
+	RSSI int `json:"rssi"`
+}
+
+// GetVersion retrieves information about the bridge and its firmware
+func (c *restAPIClient) GetVersion(ctx context.Context) (*Version, error) {
+	version := &Version{}
+	if err := c.get(ctx, "v2/sys/version", version); err != nil {
+		return nil, err
+	}
+	return version, nil
+}
+
+// GetDiagnostics retrieves the bridge's diagnostic counters, which vary between firmware versions, see
+// http://docs-local.appbond.com/#tag/Diagnostics/paths/~1v2~1sys~1diag/get
+func (c *restAPIClient) GetDiagnostics(ctx context.Context) (json.RawMessage, error) {
+	var diagnostics json.RawMessage
+	if err := c.get(ctx, "v2/sys/diag", &diagnostics); err != nil {
+		return nil, err
+	}
+	return diagnostics, nil
+}
+
+// GetWiFiStatus retrieves the bridge's connection to the Wi-Fi network
+func (c *restAPIClient) GetWiFiStatus(ctx context.Context) (*WiFiStatus, error) {
+	status := &WiFiStatus{}
+	if err := c.get(ctx, "v2/sys/wifi/sta", status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
@@ -0,0 +1,65 @@
+package bondhome
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func Test_restAPIClient_getVersion(t *testing.T) {
+	ts, client, received := setupTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		expectToken(t, r)
+		expectMethod(t, http.MethodGet, r)
+		expectURLPath(t, "/v2/sys/version", r)
+
+		w.Write([]byte(`{"target": "zermatt", "fw_ver": "v2.10.8", "fw_date": "Fri Jan 31 2020", "uptime_s": 3600, "make": "Olibra", "model": "BD-1000", "bondid": "ZZBL12345", "api": 2, "_": "7fc1e84b"}`))
+	})
+	defer ts.Close()
+
+	version, err := client.GetVersion(context.Background())
+
+	if err != nil {
+		t.Fatalf("unexpected request error: %v", err)
+	}
+
+	expectRequestReceived(t, received)
+
+	expected := &Version{
+		Target:          "zermatt",
+		FirmwareVersion: "v2.10.8",
+		FirmwareDate:    "Fri Jan 31 2020",
+		Uptime:          3600,
+		Make:            "Olibra",
+		Model:           "BD-1000",
+		BondID:          "ZZBL12345",
+		API:             2,
+	}
+	if !reflect.DeepEqual(version, expected) {
+		t.Fatalf("expected version %+v but was %+v", expected, version)
+	}
+}
+
+func Test_restAPIClient_getWiFiStatus(t *testing.T) {
+	ts, client, received := setupTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		expectToken(t, r)
+		expectMethod(t, http.MethodGet, r)
+		expectURLPath(t, "/v2/sys/wifi/sta", r)
+
+		w.Write([]byte(`{"ssid": "home", "ip": "192.168.1.2", "rssi": -67, "_": "7fc1e84b"}`))
+	})
+	defer ts.Close()
+
+	status, err := client.GetWiFiStatus(context.Background())
+
+	if err != nil {
+		t.Fatalf("unexpected request error: %v", err)
+	}
+
+	expectRequestReceived(t, received)
+
+	expected := &WiFiStatus{SSID: "home", IP: "192.168.1.2", RSSI: -67}
+	if !reflect.DeepEqual(status, expected) {
+		t.Fatalf("expected status %+v but was %+v", expected, status)
+	}
+}
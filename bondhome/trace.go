@@ -0,0 +1,26 @@
+package bondhome
+
+import "context"
+
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of ctx carrying id, which is logged along
+// with the requests made with it, to trace them back to what caused them
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the ID carried by ctx, or "" if there is none
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// tracePrefix returns the request ID carried by ctx
+// formatted to start a log message, if there is one
+func tracePrefix(ctx context.Context) string {
+	if id := RequestID(ctx); id != "" {
+		return "[" + id + "] "
+	}
+	return ""
+}
@@ -0,0 +1,549 @@
+// Package config loads and validates the configuration of bondhome-mqtt
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ssmall/bondhome-mqtt/topic"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// DefaultTopicPrefix is the prefix of every topic, unless configured otherwise
+	DefaultTopicPrefix = "bondhome"
+	// DefaultDiscoveryPrefix is the Home Assistant discovery prefix, unless configured otherwise
+	DefaultDiscoveryPrefix = "homeassistant"
+	// DefaultHealthInterval is how often bridge health is published, unless configured otherwise
+	DefaultHealthInterval = 5 * time.Minute
+	// DefaultRefreshInterval is how often devices are listed again, unless configured otherwise
+	DefaultRefreshInterval = 10 * time.Minute
+	// DefaultRequestTimeout limits each attempt of a request to a bridge, unless configured otherwise
+	DefaultRequestTimeout = 10 * time.Second
+	// DefaultRequestRetries is how many times a failed request to a bridge is retried, unless configured otherwise
+	DefaultRequestRetries = 2
+)
+
+// Config is the complete configuration of bondhome-mqtt
+type Config struct {
+	MQTT    MQTT     `yaml:"mqtt"`
+	Bridges []Bridge `yaml:"bridges"`
+
+	// TopicPrefix is prepended to every topic that is published or subscribed to
+	TopicPrefix string `yaml:"topic_prefix"`
+	// DiscoveryPrefix is the topic prefix for Home Assistant
+	// MQTT discovery; discovery is disabled if it is empty
+	DiscoveryPrefix string `yaml:"discovery_prefix"`
+	// Topics lays out the topics of each device
+	Topics Topics `yaml:"topics"`
+	// StateFields enables publishing each field of a device's
+	// state to its own subtopic of the state topic, e.g. state/speed
+	StateFields bool `yaml:"state_fields"`
+	// MergeState merges the fields of each state update from a bridge into the
+	// device's last known state before publishing it, for bridges that only
+	// send the fields that have changed
+	MergeState bool `yaml:"merge_state"`
+	// CommandResults publishes the result of each message to an action or
+	// command topic to <topic>/result, so that its sender learns whether it
+	// succeeded
+	CommandResults bool `yaml:"command_results"`
+	// HealthInterval is how often each bridge's info and health
+	// are published; they aren't published if it is zero
+	HealthInterval time.Duration `yaml:"health_interval"`
+	// RefreshInterval is how often each bridge's devices are listed again to pick up
+	// devices that were added, changed or removed; they are also listed again
+	// whenever the bridge reports such a change, so it may be zero
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+	// RequestTimeout limits each attempt of a request to a bridge's
+	// local API; requests aren't limited if it is zero
+	RequestTimeout time.Duration `yaml:"request_timeout"`
+	// RequestRetries is how many times a failed request to a bridge's local API
+	// is retried, if retrying it can't repeat its effect on a device
+	RequestRetries int `yaml:"request_retries"`
+	// MetricsAddress is the address, e.g. ":9090", to serve Prometheus
+	// metrics on at /metrics; metrics aren't served if it is empty
+	MetricsAddress string `yaml:"metrics_address"`
+
+	Devices DeviceFilter `yaml:"devices"`
+}
+
+// NamespaceByBridge reports whether topics include the Bond ID of the bridge
+// that a device belongs to, which is the case when there is more than one
+// bridge, so that the IDs of their devices can't collide
+func (c *Config) NamespaceByBridge() bool {
+	return len(c.Bridges) > 1
+}
+
+// MQTT configures the connection to the MQTT broker
+type MQTT struct {
+	// Broker is the address of the broker, e.g. tcp://localhost:1883
+	Broker       string `yaml:"broker"`
+	Username     string `yaml:"username"`
+	Password     string `yaml:"password"`
+	PasswordFile string `yaml:"password_file"`
+	TLS          TLS    `yaml:"tls"`
+
+	// QoS is used for every subscription and publication,
+	// unless the class of topic has a QoS of its own
+	QoS byte `yaml:"qos"`
+	// Retain controls whether updates from the bridge other than
+	// state, e.g. to a device's properties, are retained by the broker
+	Retain bool `yaml:"retain"`
+
+	// Commands configures the subscriptions to command topics, which include
+	// actions, commands, state/set and schedule requests. They can't be retained.
+	Commands TopicClass `yaml:"commands"`
+	// State configures the publications of device and group state, which are retained by default
+	State TopicClass `yaml:"state"`
+	// Metadata configures the publications of Home Assistant discovery
+	// configs and bridge info and health, which are retained by default
+	Metadata TopicClass `yaml:"metadata"`
+
+	// ManualAck acknowledges messages to command topics only once they have been
+	// handled, and resumes the session with the broker on reconnecting, so that
+	// the broker redelivers messages that couldn't be handled because the bridge
+	// couldn't be reached. It requires a commands QoS of 1 or 2.
+	ManualAck bool `yaml:"manual_ack"`
+
+	// Version is the version of MQTT to connect to the broker with, MQTTv311 (the
+	// default) or MQTTv5. With MQTT 5, messages to command topics that carry a
+	// response topic are replied to with the result of handling them. It can't be
+	// combined with ManualAck, since sessions start clean with MQTT 5.
+	Version string `yaml:"version"`
+}
+
+// The versions of MQTT that can be connected to the broker with
+const (
+	MQTTv311 = "3.1.1"
+	MQTTv5   = "5"
+)
+
+// TopicClass configures the QoS and retain flag of a class of topics.
+// Fields that are unset fall back to the defaults of the class.
+type TopicClass struct {
+	QoS    *byte `yaml:"qos"`
+	Retain *bool `yaml:"retain"`
+}
+
+// Policy is the QoS and retain flag that a class of topics is published or subscribed with
+type Policy struct {
+	QoS    byte
+	Retain bool
+}
+
+func (t TopicClass) policy(qos byte, retain bool) Policy {
+	p := Policy{QoS: qos, Retain: retain}
+	if t.QoS != nil {
+		p.QoS = *t.QoS
+	}
+	if t.Retain != nil {
+		p.Retain = *t.Retain
+	}
+	return p
+}
+
+// CommandPolicy is used to subscribe to command topics,
+// and to publish responses to schedule requests
+func (m MQTT) CommandPolicy() Policy {
+	return m.Commands.policy(m.QoS, false)
+}
+
+// StatePolicy is used to publish the state of devices and groups
+func (m MQTT) StatePolicy() Policy {
+	return m.State.policy(m.QoS, true)
+}
+
+// MetadataPolicy is used to publish Home Assistant
+// discovery configs and bridge info and health
+func (m MQTT) MetadataPolicy() Policy {
+	return m.Metadata.policy(m.QoS, true)
+}
+
+// TLS configures a secure connection to the MQTT broker
+type TLS struct {
+	CAFile             string `yaml:"ca_file"`
+	CertFile           string `yaml:"cert_file"`
+	KeyFile            string `yaml:"key_file"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+// Topics are templates for the topics of each device, group and bridge,
+// see the topic package for the placeholders they may contain
+type Topics struct {
+	// Device is the prefix of device topics that have no template of their own
+	Device topic.Template `yaml:"device"`
+	// State is the topic that a device's state is published to
+	State topic.Template `yaml:"state"`
+	// Action is the topic that executes an action, which must contain {action}.
+	// The topic for {action} "action" executes the action named by the payload.
+	Action topic.Template `yaml:"action"`
+	// Group is the prefix of a group's topics, which must contain {group_id}
+	Group topic.Template `yaml:"group"`
+	// Bridge is the prefix of the bridge's status, info and health topics
+	Bridge topic.Template `yaml:"bridge"`
+}
+
+// Bridge configures the connection to a Bond bridge,
+// which is identified by either its address or its ID
+type Bridge struct {
+	// Address is the hostname or IP address of the bridge
+	Address string `yaml:"address"`
+	// ID is the Bond ID of the bridge, e.g. ZZBL12345, which is used
+	// to find its address via mDNS, and again whenever it can't be reached
+	ID string `yaml:"id"`
+	// Token is the bridge's local API token
+	Token string `yaml:"token"`
+}
+
+// String identifies the bridge in log messages
+func (b Bridge) String() string {
+	if b.ID != "" {
+		return b.ID
+	}
+	return b.Address
+}
+
+// DeviceFilter selects which devices are bridged to MQTT. Entries
+// match a device's ID, name or type (e.g. "CF"), ignoring case.
+type DeviceFilter struct {
+	// Include lists the devices to bridge; if empty, all devices are included
+	Include []string `yaml:"include"`
+	// Exclude lists devices that are not bridged, even if they are included
+	Exclude []string `yaml:"exclude"`
+}
+
+// Allows reports whether a device is selected by the filter
+func (f DeviceFilter) Allows(id string, name string, deviceType string) bool {
+	matches := func(entries []string) bool {
+		for _, e := range entries {
+			if strings.EqualFold(e, id) || strings.EqualFold(e, name) || strings.EqualFold(e, deviceType) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(f.Include) > 0 && !matches(f.Include) {
+		return false
+	}
+	return !matches(f.Exclude)
+}
+
+// Default returns the configuration used when nothing else is specified
+func Default() *Config {
+	return &Config{
+		TopicPrefix:     DefaultTopicPrefix,
+		DiscoveryPrefix: DefaultDiscoveryPrefix,
+		HealthInterval:  DefaultHealthInterval,
+		RefreshInterval: DefaultRefreshInterval,
+		RequestTimeout:  DefaultRequestTimeout,
+		RequestRetries:  DefaultRequestRetries,
+		Topics: Topics{
+			Device: "{base}/devices/{device_id}",
+			State:  "{base}/devices/{device_id}/state",
+			Action: "{base}/devices/{device_id}/{action}",
+			Group:  "{base}/groups/{group_id}",
+			Bridge: "{base}/bridge",
+		},
+	}
+}
+
+// Load reads the YAML configuration file at path, if path isn't empty,
+// and applies any environment variable overrides on top of it
+func Load(path string) (*Config, error) {
+	c := Default()
+
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading config file: %w", err)
+		}
+		decoder := yaml.NewDecoder(bytes.NewReader(b))
+		// Report misspelled settings rather than silently ignoring them
+		decoder.KnownFields(true)
+		if err := decoder.Decode(c); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("error parsing config file %q: %w", path, err)
+		}
+	}
+
+	if err := c.applyEnv(os.LookupEnv); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// envOverrides maps environment variables to the setting they override. Like the
+// equivalent flags, overriding one of two alternative settings, e.g. a password or
+// a password file, clears the other.
+var envOverrides = map[string]func(c *Config, value string) error{
+	"BONDHOME_MQTT_BROKER":        func(c *Config, v string) error { c.MQTT.Broker = v; return nil },
+	"BONDHOME_MQTT_USERNAME":      func(c *Config, v string) error { c.MQTT.Username = v; return nil },
+	"BONDHOME_MQTT_PASSWORD":      func(c *Config, v string) error { c.MQTT.Password, c.MQTT.PasswordFile = v, ""; return nil },
+	"BONDHOME_MQTT_PASSWORD_FILE": func(c *Config, v string) error { c.MQTT.PasswordFile, c.MQTT.Password = v, ""; return nil },
+	"BONDHOME_MQTT_QOS": func(c *Config, v string) error {
+		qos, err := strconv.ParseUint(v, 10, 8)
+		c.MQTT.QoS = byte(qos)
+		return err
+	},
+	"BONDHOME_MQTT_RETAIN": func(c *Config, v string) error {
+		retain, err := strconv.ParseBool(v)
+		c.MQTT.Retain = retain
+		return err
+	},
+	"BONDHOME_MQTT_MANUAL_ACK": func(c *Config, v string) error {
+		manualAck, err := strconv.ParseBool(v)
+		c.MQTT.ManualAck = manualAck
+		return err
+	},
+	"BONDHOME_MQTT_VERSION":     func(c *Config, v string) error { c.MQTT.Version = v; return nil },
+	"BONDHOME_BRIDGE_ADDRESS":   func(c *Config, v string) error { b := c.FirstBridge(); b.Address, b.ID = v, ""; return nil },
+	"BONDHOME_BRIDGE_ID":        func(c *Config, v string) error { b := c.FirstBridge(); b.ID, b.Address = v, ""; return nil },
+	"BONDHOME_BRIDGE_TOKEN":     func(c *Config, v string) error { c.FirstBridge().Token = v; return nil },
+	"BONDHOME_TOPIC_PREFIX":     func(c *Config, v string) error { c.TopicPrefix = v; return nil },
+	"BONDHOME_DISCOVERY_PREFIX": func(c *Config, v string) error { c.DiscoveryPrefix = v; return nil },
+	"BONDHOME_METRICS_ADDRESS":  func(c *Config, v string) error { c.MetricsAddress = v; return nil },
+	"BONDHOME_HEALTH_INTERVAL": func(c *Config, v string) error {
+		interval, err := time.ParseDuration(v)
+		c.HealthInterval = interval
+		return err
+	},
+	"BONDHOME_REFRESH_INTERVAL": func(c *Config, v string) error {
+		interval, err := time.ParseDuration(v)
+		c.RefreshInterval = interval
+		return err
+	},
+	"BONDHOME_REQUEST_TIMEOUT": func(c *Config, v string) error {
+		timeout, err := time.ParseDuration(v)
+		c.RequestTimeout = timeout
+		return err
+	},
+	"BONDHOME_REQUEST_RETRIES": func(c *Config, v string) error {
+		retries, err := strconv.Atoi(v)
+		c.RequestRetries = retries
+		return err
+	},
+	"BONDHOME_STATE_FIELDS": func(c *Config, v string) error {
+		stateFields, err := strconv.ParseBool(v)
+		c.StateFields = stateFields
+		return err
+	},
+	"BONDHOME_COMMAND_RESULTS": func(c *Config, v string) error {
+		commandResults, err := strconv.ParseBool(v)
+		c.CommandResults = commandResults
+		return err
+	},
+	"BONDHOME_MERGE_STATE": func(c *Config, v string) error {
+		mergeState, err := strconv.ParseBool(v)
+		c.MergeState = mergeState
+		return err
+	},
+}
+
+// applyEnv applies the overrides in order of their names, so that if both of two
+// alternative settings are set, the same one wins each time, as with the flags
+func (c *Config) applyEnv(lookup func(string) (string, bool)) error {
+	names := make([]string, 0, len(envOverrides))
+	for name := range envOverrides {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if v, ok := lookup(name); ok {
+			if err := envOverrides[name](c, v); err != nil {
+				return fmt.Errorf("invalid value %q for %s: %w", v, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// FirstBridge returns the first configured bridge, adding one if there are none
+func (c *Config) FirstBridge() *Bridge {
+	if len(c.Bridges) == 0 {
+		c.Bridges = append(c.Bridges, Bridge{})
+	}
+	return &c.Bridges[0]
+}
+
+// ValidationError lists every problem found in a configuration
+type ValidationError []string
+
+func (e ValidationError) Error() string {
+	return "invalid configuration:\n  " + strings.Join(e, "\n  ")
+}
+
+// Validate checks the configuration for errors, returning
+// a ValidationError describing all of them if there are any
+func (c *Config) Validate() error {
+	var errs ValidationError
+
+	if c.MQTT.Broker == "" {
+		errs = append(errs, "mqtt.broker must be specified")
+	} else if u, err := url.Parse(c.MQTT.Broker); err != nil || u.Scheme == "" || u.Host == "" {
+		errs = append(errs, fmt.Sprintf("mqtt.broker %q must be a URL like tcp://<host>:<port>", c.MQTT.Broker))
+	}
+	if c.MQTT.Password != "" && c.MQTT.PasswordFile != "" {
+		errs = append(errs, "only one of mqtt.password and mqtt.password_file may be specified")
+	}
+	if (c.MQTT.TLS.CertFile == "") != (c.MQTT.TLS.KeyFile == "") {
+		errs = append(errs, "mqtt.tls.cert_file and mqtt.tls.key_file must be specified together")
+	}
+	if c.MQTT.QoS > 2 {
+		errs = append(errs, fmt.Sprintf("mqtt.qos must be 0, 1 or 2 but was %d", c.MQTT.QoS))
+	}
+	for _, class := range []struct {
+		name  string
+		class TopicClass
+	}{
+		{"commands", c.MQTT.Commands},
+		{"state", c.MQTT.State},
+		{"metadata", c.MQTT.Metadata},
+	} {
+		if class.class.QoS != nil && *class.class.QoS > 2 {
+			errs = append(errs, fmt.Sprintf("mqtt.%s.qos must be 0, 1 or 2 but was %d", class.name, *class.class.QoS))
+		}
+	}
+	if c.MQTT.Commands.Retain != nil {
+		errs = append(errs, "mqtt.commands.retain must not be specified, since commands are subscribed to")
+	}
+	if c.MQTT.ManualAck && c.MQTT.CommandPolicy().QoS == 0 {
+		errs = append(errs, "mqtt.manual_ack requires mqtt.qos or mqtt.commands.qos to be 1 or 2")
+	}
+	switch c.MQTT.Version {
+	case "", MQTTv311:
+	case MQTTv5:
+		if c.MQTT.ManualAck {
+			errs = append(errs, "mqtt.manual_ack is not supported with mqtt.version "+MQTTv5)
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("mqtt.version must be %q or %q but was %q", MQTTv311, MQTTv5, c.MQTT.Version))
+	}
+
+	if c.HealthInterval < 0 {
+		errs = append(errs, fmt.Sprintf("health_interval must not be negative but was %s", c.HealthInterval))
+	}
+	if c.RefreshInterval < 0 {
+		errs = append(errs, fmt.Sprintf("refresh_interval must not be negative but was %s", c.RefreshInterval))
+	}
+	if c.RequestTimeout < 0 {
+		errs = append(errs, fmt.Sprintf("request_timeout must not be negative but was %s", c.RequestTimeout))
+	}
+	if c.RequestRetries < 0 {
+		errs = append(errs, fmt.Sprintf("request_retries must not be negative but was %d", c.RequestRetries))
+	}
+	if c.MetricsAddress != "" {
+		if _, _, err := net.SplitHostPort(c.MetricsAddress); err != nil {
+			errs = append(errs, fmt.Sprintf("metrics_address must be a host and port, e.g. :9090: %v", err))
+		}
+	}
+
+	if len(c.Bridges) == 0 {
+		errs = append(errs, "at least one bridge must be specified")
+	}
+	addresses := make(map[string]bool, len(c.Bridges))
+	ids := make(map[string]bool, len(c.Bridges))
+	for i, b := range c.Bridges {
+		switch {
+		case b.Address == "" && b.ID == "":
+			errs = append(errs, fmt.Sprintf("bridges[%d].address or bridges[%d].id must be specified", i, i))
+		case b.Address != "" && b.ID != "":
+			errs = append(errs, fmt.Sprintf("only one of bridges[%d].address and bridges[%d].id may be specified", i, i))
+		case addresses[b.Address]:
+			errs = append(errs, fmt.Sprintf("bridges[%d].address %q is specified more than once", i, b.Address))
+		case ids[strings.ToUpper(b.ID)]:
+			errs = append(errs, fmt.Sprintf("bridges[%d].id %q is specified more than once", i, b.ID))
+		}
+		if b.Address != "" {
+			addresses[b.Address] = true
+		}
+		if b.ID != "" {
+			ids[strings.ToUpper(b.ID)] = true
+		}
+		if b.Token == "" {
+			errs = append(errs, fmt.Sprintf("bridges[%d].token must be specified", i))
+		}
+	}
+
+	if c.TopicPrefix == "" {
+		errs = append(errs, "topic_prefix must not be empty")
+	}
+	for _, p := range []struct{ name, value string }{
+		{"topic_prefix", c.TopicPrefix},
+		{"discovery_prefix", c.DiscoveryPrefix},
+	} {
+		if strings.ContainsAny(p.value, "+#") || strings.HasPrefix(p.value, "/") || strings.HasSuffix(p.value, "/") {
+			errs = append(errs, fmt.Sprintf("%s %q must not contain wildcards or start or end with '/'", p.name, p.value))
+		}
+	}
+
+	devicePlaceholders := []string{topic.DeviceID, topic.Name, topic.Location, topic.Type, topic.Action}
+	for _, t := range []struct {
+		name     string
+		template topic.Template
+		// needs are the placeholders that the template must contain one of
+		needs []string
+		// unset are the placeholders that have no value in the template's topics
+		unset []string
+	}{
+		{"topics.device", c.Topics.Device, []string{topic.DeviceID, topic.Name}, []string{topic.GroupID}},
+		{"topics.state", c.Topics.State, []string{topic.DeviceID, topic.Name}, []string{topic.GroupID}},
+		{"topics.action", c.Topics.Action, []string{topic.DeviceID, topic.Name}, []string{topic.GroupID}},
+		{"topics.group", c.Topics.Group, []string{topic.GroupID}, devicePlaceholders},
+		{"topics.bridge", c.Topics.Bridge, nil, append(devicePlaceholders, topic.GroupID)},
+	} {
+		if err := t.template.Validate(); err != nil {
+			errs = append(errs, fmt.Sprintf("%s %q is invalid: %v", t.name, t.template, err))
+			continue
+		}
+		if len(t.needs) > 0 && !usesAny(t.template, t.needs) {
+			errs = append(errs, fmt.Sprintf("%s %q must contain {%s}", t.name, t.template, strings.Join(t.needs, "} or {")))
+		}
+		for _, p := range t.unset {
+			if t.template.Uses(p) {
+				errs = append(errs, fmt.Sprintf("%s %q must not contain {%s}", t.name, t.template, p))
+			}
+		}
+	}
+	if !c.Topics.Action.Uses(topic.Action) {
+		errs = append(errs, fmt.Sprintf("topics.action %q must contain {%s}", c.Topics.Action, topic.Action))
+	}
+	if c.NamespaceByBridge() && !usesAny(c.Topics.Bridge, []string{topic.Base, topic.BondID}) {
+		errs = append(errs, fmt.Sprintf("topics.bridge %q must contain {%s} or {%s} when there is more than one bridge", c.Topics.Bridge, topic.Base, topic.BondID))
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// usesAny reports whether the template contains any of the placeholders
+func usesAny(t topic.Template, placeholders []string) bool {
+	for _, p := range placeholders {
+		if t.Uses(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// ResolvePassword returns the MQTT password, reading it from PasswordFile if one is set
+func (m MQTT) ResolvePassword() (string, error) {
+	if m.PasswordFile == "" {
+		return m.Password, nil
+	}
+	b, err := os.ReadFile(m.PasswordFile)
+	if err != nil {
+		return "", fmt.Errorf("error reading password file: %w", err)
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
@@ -0,0 +1,306 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatalf("error writing config file: %v", err)
+	}
+	return path
+}
+
+func Test_Load(t *testing.T) {
+	path := writeConfigFile(t, `
+mqtt:
+  broker: ssl://broker.example.com:8883
+  username: bond
+  qos: 1
+  tls:
+    ca_file: /etc/ssl/ca.pem
+bridges:
+  - address: 192.168.1.2
+    token: file-token
+topic_prefix: home/bond
+health_interval: 1m
+topics:
+  state: home/{location}/{name}/state
+  action: home/{location}/{name}/set/{action}
+devices:
+  exclude: [GX]
+`)
+	t.Setenv("BONDHOME_BRIDGE_TOKEN", "env-token")
+
+	c, err := Load(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := &Config{
+		MQTT: MQTT{
+			Broker:   "ssl://broker.example.com:8883",
+			Username: "bond",
+			QoS:      1,
+			TLS:      TLS{CAFile: "/etc/ssl/ca.pem"},
+		},
+		Bridges:         []Bridge{{Address: "192.168.1.2", Token: "env-token"}},
+		TopicPrefix:     "home/bond",
+		DiscoveryPrefix: DefaultDiscoveryPrefix,
+		HealthInterval:  time.Minute,
+		RefreshInterval: DefaultRefreshInterval,
+		RequestTimeout:  DefaultRequestTimeout,
+		RequestRetries:  DefaultRequestRetries,
+		Topics: Topics{
+			Device: "{base}/devices/{device_id}",
+			State:  "home/{location}/{name}/state",
+			Action: "home/{location}/{name}/set/{action}",
+			Group:  "{base}/groups/{group_id}",
+			Bridge: "{base}/bridge",
+		},
+		Devices: DeviceFilter{Exclude: []string{"GX"}},
+	}
+	if !reflect.DeepEqual(c, expected) {
+		t.Fatalf("expected:\n%#v\nbut was:\n%#v", *expected, *c)
+	}
+
+	if err := c.Validate(); err != nil {
+		t.Fatalf("unexpected validation error: %v", err)
+	}
+}
+
+func Test_Load_envOnly(t *testing.T) {
+	t.Setenv("BONDHOME_MQTT_BROKER", "tcp://localhost:1883")
+	t.Setenv("BONDHOME_BRIDGE_ADDRESS", "bond.local")
+	t.Setenv("BONDHOME_BRIDGE_TOKEN", "token")
+
+	c, err := Load("")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("unexpected validation error: %v", err)
+	}
+	if c.TopicPrefix != DefaultTopicPrefix {
+		t.Errorf("expected default topic prefix %q but got %q", DefaultTopicPrefix, c.TopicPrefix)
+	}
+}
+
+func Test_Load_bridgeID(t *testing.T) {
+	path := writeConfigFile(t, `
+mqtt:
+  broker: tcp://localhost:1883
+bridges:
+  - id: ZZBL12345
+    token: token
+`)
+
+	c, err := Load(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("unexpected validation error: %v", err)
+	}
+	expected := []Bridge{{ID: "ZZBL12345", Token: "token"}}
+	if !reflect.DeepEqual(c.Bridges, expected) {
+		t.Fatalf("expected bridges %+v but got %+v", expected, c.Bridges)
+	}
+}
+
+func Test_Load_envReplacesAlternative(t *testing.T) {
+	path := writeConfigFile(t, `
+mqtt:
+  broker: tcp://localhost:1883
+  username: bond
+  password_file: /run/secrets/mqtt
+bridges:
+  - id: ZZBL12345
+    token: token
+`)
+	t.Setenv("BONDHOME_MQTT_PASSWORD", "secret")
+	t.Setenv("BONDHOME_BRIDGE_ADDRESS", "192.168.1.2")
+
+	c, err := Load(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("unexpected validation error: %v", err)
+	}
+	if c.MQTT.Password != "secret" || c.MQTT.PasswordFile != "" {
+		t.Errorf("expected the password to replace the password file but got %+v", c.MQTT)
+	}
+	expected := []Bridge{{Address: "192.168.1.2", Token: "token"}}
+	if !reflect.DeepEqual(c.Bridges, expected) {
+		t.Fatalf("expected bridges %+v but got %+v", expected, c.Bridges)
+	}
+}
+
+func Test_Load_unknownSetting(t *testing.T) {
+	path := writeConfigFile(t, `
+mqtt:
+  brokr: tcp://localhost:1883
+`)
+	if _, err := Load(path); err == nil {
+		t.Fatalf("expected an error for a misspelled setting but got none")
+	}
+}
+
+func Test_Load_invalidEnv(t *testing.T) {
+	t.Setenv("BONDHOME_MQTT_QOS", "high")
+	if _, err := Load(""); err == nil || !strings.Contains(err.Error(), "BONDHOME_MQTT_QOS") {
+		t.Fatalf("expected an error naming BONDHOME_MQTT_QOS but got: %v", err)
+	}
+}
+
+func Test_Validate(t *testing.T) {
+	c := Default()
+	c.MQTT.Broker = "localhost"
+	c.MQTT.QoS = 3
+	c.MQTT.TLS.CertFile = "cert.pem"
+	c.Bridges = []Bridge{
+		{Address: "bond.local"},
+		{Address: "bond.local", Token: "token"},
+		{Address: "192.168.1.2", ID: "ZZBL12345", Token: "token"},
+		{ID: "zzbl54321", Token: "token"},
+		{ID: "ZZBL54321", Token: "token"},
+		{Token: "token"},
+	}
+	c.TopicPrefix = "bondhome/"
+	c.Topics.State = "{base}/{room}/state"
+	c.Topics.Action = "{base}/devices/{device_id}/set"
+	c.Topics.Group = "{base}/groups/{name}"
+	c.Topics.Bridge = "home/bridge"
+	c.RequestRetries = -1
+
+	err := c.Validate()
+	if err == nil {
+		t.Fatalf("expected an error but got none")
+	}
+
+	errs, ok := err.(ValidationError)
+	if !ok {
+		t.Fatalf("expected a ValidationError but got %T", err)
+	}
+	for _, expected := range []string{"mqtt.broker", "mqtt.qos", "mqtt.tls.cert_file", "bridges[0].token", "bridges[1].address", "bridges[2].address", "bridges[4].id", "bridges[5].address", "topic_prefix", "topics.state", "topics.action", "topics.group", "topics.bridge", "request_retries"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected error mentioning %s but was: %v", expected, err)
+		}
+	}
+	if len(errs) != 15 {
+		t.Errorf("expected 15 errors but got %d: %v", len(errs), err)
+	}
+}
+
+func Test_MQTT_policies(t *testing.T) {
+	path := writeConfigFile(t, `
+mqtt:
+  broker: tcp://localhost:1883
+  qos: 1
+  manual_ack: true
+  state:
+    retain: false
+  metadata:
+    qos: 0
+bridges:
+  - address: 192.168.1.2
+    token: token
+`)
+	c, err := Load(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("unexpected validation error: %v", err)
+	}
+
+	for name, tt := range map[string]struct{ actual, expected Policy }{
+		"commands": {c.MQTT.CommandPolicy(), Policy{QoS: 1, Retain: false}},
+		"state":    {c.MQTT.StatePolicy(), Policy{QoS: 1, Retain: false}},
+		"metadata": {c.MQTT.MetadataPolicy(), Policy{QoS: 0, Retain: true}},
+	} {
+		if tt.actual != tt.expected {
+			t.Errorf("expected %s policy %+v but got %+v", name, tt.expected, tt.actual)
+		}
+	}
+}
+
+func Test_Validate_mqttPolicies(t *testing.T) {
+	c := Default()
+	c.MQTT.Broker = "tcp://localhost:1883"
+	c.Bridges = []Bridge{{Address: "192.168.1.2", Token: "token"}}
+	c.MQTT.ManualAck = true
+	three, retain := byte(3), true
+	c.MQTT.State.QoS = &three
+	c.MQTT.Commands.Retain = &retain
+
+	err := c.Validate()
+	if err == nil {
+		t.Fatalf("expected an error but got none")
+	}
+	for _, expected := range []string{"mqtt.state.qos", "mqtt.commands.retain", "mqtt.manual_ack"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected error mentioning %s but was: %v", expected, err)
+		}
+	}
+}
+
+func Test_Validate_mqttVersion(t *testing.T) {
+	tests := []struct {
+		version   string
+		manualAck bool
+		expected  string
+	}{
+		{"", true, ""},
+		{MQTTv311, true, ""},
+		{MQTTv5, false, ""},
+		{MQTTv5, true, "mqtt.manual_ack"},
+		{"4", false, "mqtt.version"},
+	}
+	for _, tt := range tests {
+		c := Default()
+		c.MQTT.Broker = "tcp://localhost:1883"
+		c.MQTT.QoS = 1
+		c.Bridges = []Bridge{{Address: "192.168.1.2", Token: "token"}}
+		c.MQTT.Version = tt.version
+		c.MQTT.ManualAck = tt.manualAck
+
+		err := c.Validate()
+		if tt.expected == "" && err != nil {
+			t.Errorf("version %q, manual_ack %v: unexpected error: %v", tt.version, tt.manualAck, err)
+		}
+		if tt.expected != "" && (err == nil || !strings.Contains(err.Error(), tt.expected)) {
+			t.Errorf("version %q, manual_ack %v: expected error mentioning %s but was: %v", tt.version, tt.manualAck, tt.expected, err)
+		}
+	}
+}
+
+func Test_DeviceFilter_Allows(t *testing.T) {
+	tests := []struct {
+		name     string
+		filter   DeviceFilter
+		expected bool
+	}{
+		{"empty filter", DeviceFilter{}, true},
+		{"included by ID", DeviceFilter{Include: []string{"aabbccdd"}}, true},
+		{"included by name", DeviceFilter{Include: []string{"living room fan"}}, true},
+		{"not included", DeviceFilter{Include: []string{"11223344"}}, false},
+		{"excluded by type", DeviceFilter{Exclude: []string{"cf"}}, false},
+		{"included and excluded", DeviceFilter{Include: []string{"CF"}, Exclude: []string{"aabbccdd"}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if actual := tt.filter.Allows("aabbccdd", "Living Room Fan", "CF"); actual != tt.expected {
+				t.Fatalf("expected %v but got %v", tt.expected, actual)
+			}
+		})
+	}
+}
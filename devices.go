@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/ssmall/bondhome-mqtt/bondhome"
+	"golang.org/x/sync/errgroup"
+)
+
+// setupDeviceActionHandlers sets up each of the bridge's devices on startup
+func (r *relay) setupDeviceActionHandlers(ctx context.Context) error {
+	if err := r.syncDevices(ctx); err != nil {
+		return fmt.Errorf("error setting up listeners: %w", err)
+	}
+	return nil
+}
+
+// requestRefresh asks for the bridge's devices to be listed
+// again, unless that has already been requested
+func (r *relay) requestRefresh() {
+	select {
+	case r.refresh <- struct{}{}:
+	default:
+	}
+}
+
+// watchDevices lists the bridge's devices again at every interval, if it
+// isn't zero, and whenever a refresh is requested, until ctx is done
+func (r *relay) watchDevices(ctx context.Context, interval time.Duration) {
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-tick:
+		case <-r.refresh:
+		case <-ctx.Done():
+			return
+		}
+
+		glog.V(1).Infof("Refreshing devices of Bond bridge %q", r.bondID)
+		if err := r.syncDevices(ctx); err != nil {
+			glog.Errorf("Unable to refresh devices of Bond bridge %q: %v", r.bondID, err)
+		}
+	}
+}
+
+// syncDevices sets up devices that have been added to the bridge, or changed,
+// since it was last called, and removes those that have been removed from it
+func (r *relay) syncDevices(ctx context.Context) error {
+	devices, err := r.bridge.GetDeviceIDs(ctx)
+	if err != nil {
+		return fmt.Errorf("could not get devices from bridge: %w", err)
+	}
+
+	glog.V(1).Infoln("Got device IDs: ", devices)
+
+	current := make(map[string]bool, len(devices))
+	for _, deviceID := range devices {
+		current[deviceID] = true
+	}
+
+	var removed []string
+	r.mu.Lock()
+	for deviceID := range r.handled {
+		if !current[deviceID] {
+			removed = append(removed, deviceID)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, deviceID := range removed {
+		glog.Infof("Device %q was removed from the bridge", deviceID)
+		r.removeDevice(deviceID)
+	}
+
+	var g errgroup.Group
+
+	for _, deviceID := range devices {
+		localDeviceID := deviceID
+		g.Go(func() error {
+			return r.syncDevice(ctx, localDeviceID)
+		})
+	}
+
+	return g.Wait()
+}
+
+// syncDevice sets up the device if it is new or has changed
+func (r *relay) syncDevice(ctx context.Context, deviceID string) error {
+	d, err := r.bridge.GetDevice(ctx, deviceID)
+	if errors.Is(err, bondhome.ErrNotFound) {
+		// It was removed since the devices were listed, and will be removed on the next sync
+		glog.Infof("Device %q was removed from the bridge while being synced", deviceID)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	previous, ok := r.handled[deviceID]
+	r.mu.Unlock()
+
+	if !ok {
+		glog.Infof("Discovered device with id %q: %#v", deviceID, d)
+		return r.setupDevice(ctx, deviceID, d)
+	}
+	if reflect.DeepEqual(previous, d) {
+		return nil
+	}
+
+	glog.Infof("Device %q changed, setting it up again: %#v", deviceID, d)
+	r.mu.Lock()
+	retained := r.discoveryTopics[deviceID]
+	delete(r.discoveryTopics, deviceID)
+	_, added := r.devices[deviceID]
+	r.mu.Unlock()
+	if added {
+		retained = append(retained, r.stateTopic(deviceID))
+	}
+	r.teardownDevice(deviceID)
+
+	if err := r.setupDevice(ctx, deviceID, d); err != nil {
+		// Nothing is published for the device until it is set up again
+		r.clearRetained(retained...)
+		return err
+	}
+
+	// Clear whatever is no longer published for the device
+	current := make(map[string]bool)
+	r.mu.Lock()
+	for _, topic := range r.discoveryTopics[deviceID] {
+		current[topic] = true
+	}
+	excluded := r.excluded[deviceID]
+	r.mu.Unlock()
+	if !excluded {
+		current[r.stateTopic(deviceID)] = true
+	}
+
+	var stale []string
+	for _, topic := range retained {
+		if !current[topic] {
+			stale = append(stale, topic)
+		}
+	}
+	r.clearRetained(stale...)
+	return nil
+}
+
+// setupDevice subscribes to the device's topics and publishes its discovery config
+// and state, unless it is excluded. The device is only recorded as handled once
+// that succeeds; otherwise whatever was set up is removed again, so that setting
+// it up is retried on the next sync.
+func (r *relay) setupDevice(ctx context.Context, deviceID string, d *bondhome.Device) error {
+	if !r.cfg.Devices.Allows(deviceID, d.Name, d.Type) {
+		glog.Infof("Device %q is excluded by the configuration, skipping", deviceID)
+		r.mu.Lock()
+		r.excluded[deviceID] = true
+		r.handled[deviceID] = d
+		r.mu.Unlock()
+		return nil
+	}
+
+	if err := r.relayDevice(ctx, deviceID, d); err != nil {
+		r.removeDevice(deviceID)
+		return err
+	}
+
+	r.mu.Lock()
+	r.handled[deviceID] = d
+	r.mu.Unlock()
+	return nil
+}
+
+// relayDevice does the work of setupDevice for a device that isn't excluded
+func (r *relay) relayDevice(ctx context.Context, deviceID string, d *bondhome.Device) error {
+	if err := r.addDevice(deviceID, d); err != nil {
+		return err
+	}
+
+	properties, err := r.bridge.GetDeviceProperties(ctx, deviceID)
+	if err != nil {
+		glog.Warningf("Unable to get properties of device %q: %v", deviceID, err)
+	} else {
+		glog.V(1).Infof("Got properties of device %q: %+v", deviceID, properties)
+		r.mu.Lock()
+		r.properties[deviceID] = properties
+		r.mu.Unlock()
+	}
+
+	var hg errgroup.Group
+
+	for _, actionID := range d.Actions {
+		localActionID := actionID
+		hg.Go(func() error {
+			return r.actionHandler(ctx, deviceID, localActionID)
+		})
+	}
+	hg.Go(func() error {
+		return r.dispatchHandler(ctx, deviceID)
+	})
+	hg.Go(func() error {
+		return r.commandHandlers(ctx, deviceID)
+	})
+	hg.Go(func() error {
+		return r.skedHandlers(ctx, deviceID)
+	})
+	hg.Go(func() error {
+		return r.stateUpdateHandler(ctx, deviceID)
+	})
+
+	if err := hg.Wait(); err != nil {
+		return err
+	}
+
+	if r.cfg.DiscoveryPrefix != "" {
+		if r.bondID == "" {
+			glog.Warningf("Bond ID of bridge is unknown, not publishing discovery config for device %q", deviceID)
+		} else if err := r.publishDiscovery(deviceID, d, properties); err != nil {
+			return err
+		}
+	}
+
+	r.publishInitialState(ctx, deviceID)
+	return nil
+}
+
+// teardownDevice unsubscribes from the device's topics and forgets about it
+func (r *relay) teardownDevice(deviceID string) {
+	r.mu.Lock()
+	subscriptions := r.subscriptions[deviceID]
+	delete(r.subscriptions, deviceID)
+	delete(r.handled, deviceID)
+	delete(r.excluded, deviceID)
+	delete(r.devices, deviceID)
+	delete(r.properties, deviceID)
+	for topic, id := range r.topics {
+		if id == deviceID {
+			delete(r.topics, topic)
+		}
+	}
+	r.mu.Unlock()
+
+	if len(subscriptions) == 0 {
+		return
+	}
+	token := r.mqtt.Unsubscribe(subscriptions...)
+	if token.Wait() && token.Error() != nil {
+		glog.Errorf("Unable to unsubscribe from topics of device %q: %v", deviceID, token.Error())
+	}
+}
+
+// removeDevice tears down a device that was removed from the bridge, or couldn't
+// be set up, and clears its retained state and discovery configs from the broker
+func (r *relay) removeDevice(deviceID string) {
+	r.mu.Lock()
+	// Devices that are excluded, or whose topics collide with another's, aren't added
+	_, added := r.devices[deviceID]
+	retained := r.discoveryTopics[deviceID]
+	delete(r.discoveryTopics, deviceID)
+	r.mu.Unlock()
+
+	if added {
+		retained = append(retained, r.stateTopic(deviceID))
+	}
+	r.teardownDevice(deviceID)
+	r.clearRetained(retained...)
+}
+
+// clearRetained removes the retained messages of the topics from the broker,
+// which are published with the QoS of metadata whatever their class. Clearing
+// a state topic also clears the topics that its fields were published to.
+func (r *relay) clearRetained(topics ...string) {
+	pending := append([]string(nil), topics...)
+	for i := 0; i < len(pending); i++ {
+		topic := pending[i]
+		r.mu.Lock()
+		delete(r.states, topic)
+		fieldTopics := make([]string, 0, len(r.fieldTopics[topic]))
+		for fieldTopic := range r.fieldTopics[topic] {
+			fieldTopics = append(fieldTopics, fieldTopic)
+		}
+		delete(r.fieldTopics, topic)
+		r.mu.Unlock()
+		sort.Strings(fieldTopics)
+		pending = append(pending, fieldTopics...)
+
+		glog.V(1).Infoln("Clearing retained message of topic", topic)
+		token := r.mqtt.Publish(topic, r.cfg.MQTT.MetadataPolicy().QoS, true, []byte{})
+		if token.Wait() && token.Error() != nil {
+			glog.Errorf("Unable to publish to topic %s: %v", topic, token.Error())
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+
+	"github.com/ssmall/bondhome-mqtt/bondhome"
+	"github.com/ssmall/bondhome-mqtt/config"
+)
+
+type doneToken struct{}
+
+func (doneToken) Wait() bool                     { return true }
+func (doneToken) WaitTimeout(time.Duration) bool { return true }
+func (doneToken) Done() <-chan struct{}          { c := make(chan struct{}); close(c); return c }
+func (doneToken) Error() error                   { return nil }
+
+// fakeMQTT records the topics that are subscribed to and published
+type fakeMQTT struct {
+	paho.Client
+
+	mu         sync.Mutex
+	subscribed map[string]bool
+	// handlers holds the handler of each topic subscribed to
+	handlers  map[string]paho.MessageHandler
+	published map[string]string
+	// publishes counts the messages published to each topic
+	publishes map[string]int
+}
+
+func newFakeMQTT() *fakeMQTT {
+	return &fakeMQTT{
+		subscribed: make(map[string]bool),
+		handlers:   make(map[string]paho.MessageHandler),
+		published:  make(map[string]string),
+		publishes:  make(map[string]int),
+	}
+}
+
+func (c *fakeMQTT) Subscribe(topic string, _ byte, handler paho.MessageHandler) paho.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.subscribed[topic] = true
+	c.handlers[topic] = handler
+	return doneToken{}
+}
+
+func (c *fakeMQTT) Unsubscribe(topics ...string) paho.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, t := range topics {
+		delete(c.subscribed, t)
+		delete(c.handlers, t)
+	}
+	return doneToken{}
+}
+
+func (c *fakeMQTT) Publish(topic string, _ byte, _ bool, payload interface{}) paho.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.publishes[topic]++
+	switch p := payload.(type) {
+	case string:
+		c.published[topic] = p
+	case []byte:
+		c.published[topic] = string(p)
+	}
+	return doneToken{}
+}
+
+// fakeMessage is a message from the broker that records whether it was acked
+type fakeMessage struct {
+	paho.Message
+
+	topic   string
+	payload []byte
+	acked   bool
+}
+
+func (m *fakeMessage) Topic() string     { return m.topic }
+func (m *fakeMessage) Payload() []byte   { return m.payload }
+func (m *fakeMessage) MessageID() uint16 { return 1 }
+func (m *fakeMessage) Ack()              { m.acked = true }
+
+// fakePush is a push client that has stopped listening
+type fakePush struct {
+	bondhome.PushClient
+}
+
+func (fakePush) StopListening() error { return nil }
+
+// fakeBridge serves a fixed set of devices, which tests may change
+type fakeBridge struct {
+	bondhome.Bridge
+
+	mu      sync.Mutex
+	devices map[string]*bondhome.Device
+}
+
+func (b *fakeBridge) GetDeviceIDs(context.Context) ([]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ids := make([]string, 0, len(b.devices))
+	for id := range b.devices {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (b *fakeBridge) GetDevice(_ context.Context, deviceID string) (*bondhome.Device, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	d, ok := b.devices[deviceID]
+	if !ok {
+		return nil, fmt.Errorf("no device %q", deviceID)
+	}
+	copied := *d
+	return &copied, nil
+}
+
+func (b *fakeBridge) GetDeviceProperties(context.Context, string) (*bondhome.DeviceProperties, error) {
+	return &bondhome.DeviceProperties{}, nil
+}
+
+func (b *fakeBridge) GetCommandIDs(context.Context, string) ([]string, error) {
+	return nil, nil
+}
+
+func (b *fakeBridge) GetDeviceState(context.Context, string) (json.RawMessage, error) {
+	return json.RawMessage(`{"power":0}`), nil
+}
+
+func Test_relay_syncDevices(t *testing.T) {
+	cfg := config.Default()
+	mqttClient := newFakeMQTT()
+	bridge := &fakeBridge{devices: map[string]*bondhome.Device{
+		"aabbccdd": {Name: "Fan", Type: "CF", Actions: []string{"TurnOn", "TurnOff"}},
+	}}
+	r := newRelay(cfg, mqttClient, bridge, nil)
+	r.bondID = "ZZBL12345"
+
+	if err := r.syncDevices(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	const discoveryTopic = "homeassistant/fan/ZZBL12345/aabbccdd/config"
+	for _, topic := range []string{"bondhome/devices/aabbccdd/TurnOn", "bondhome/devices/aabbccdd/action"} {
+		if !mqttClient.subscribed[topic] {
+			t.Errorf("expected a subscription to %s", topic)
+		}
+	}
+	if mqttClient.published[discoveryTopic] == "" {
+		t.Errorf("expected a discovery config to be published to %s", discoveryTopic)
+	}
+
+	// A new action is subscribed to, and a new device is set up
+	bridge.mu.Lock()
+	bridge.devices["aabbccdd"].Actions = append(bridge.devices["aabbccdd"].Actions, "SetSpeed")
+	bridge.devices["11223344"] = &bondhome.Device{Name: "Fireplace", Type: "FP", Actions: []string{"TurnOn", "TurnOff"}}
+	bridge.mu.Unlock()
+
+	if err := r.syncDevices(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, topic := range []string{"bondhome/devices/aabbccdd/SetSpeed", "bondhome/devices/11223344/TurnOn"} {
+		if !mqttClient.subscribed[topic] {
+			t.Errorf("expected a subscription to %s", topic)
+		}
+	}
+	if mqttClient.published[discoveryTopic] == "" {
+		t.Errorf("expected the discovery config of the changed device to still be published to %s", discoveryTopic)
+	}
+
+	// A removed device is unsubscribed from and its retained messages are cleared
+	bridge.mu.Lock()
+	delete(bridge.devices, "aabbccdd")
+	bridge.mu.Unlock()
+
+	if err := r.syncDevices(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for topic := range mqttClient.subscribed {
+		if topic == "bondhome/devices/aabbccdd/TurnOn" || topic == "bondhome/devices/aabbccdd/SetSpeed" {
+			t.Errorf("expected no subscription to %s", topic)
+		}
+	}
+	for _, topic := range []string{discoveryTopic, "bondhome/devices/aabbccdd/state"} {
+		if payload, ok := mqttClient.published[topic]; !ok || payload != "" {
+			t.Errorf("expected the retained message of %s to be cleared but was %q", topic, payload)
+		}
+	}
+	if !mqttClient.subscribed["bondhome/devices/11223344/TurnOn"] {
+		t.Errorf("expected the remaining device to still be subscribed to")
+	}
+}
+
+// flakyCommandBridge fails to get the commands of its devices while failing is set
+type flakyCommandBridge struct {
+	*fakeBridge
+	failing bool
+}
+
+func (b *flakyCommandBridge) GetCommandIDs(context.Context, string) ([]string, error) {
+	return []string{"a1b2"}, nil
+}
+
+func (b *flakyCommandBridge) GetCommand(context.Context, string, string) (*bondhome.Command, error) {
+	if b.failing {
+		return nil, &bondhome.StatusError{StatusCode: http.StatusServiceUnavailable}
+	}
+	return &bondhome.Command{Name: "Dim Up"}, nil
+}
+
+func Test_relay_syncDevices_retriesFailedSetup(t *testing.T) {
+	cfg := config.Default()
+	mqttClient := newFakeMQTT()
+	bridge := &flakyCommandBridge{
+		fakeBridge: &fakeBridge{devices: map[string]*bondhome.Device{
+			"aabbccdd": {Name: "Fan", Type: "CF", Actions: []string{"TurnOn", "TurnOff"}},
+		}},
+		failing: true,
+	}
+	r := newRelay(cfg, mqttClient, bridge, nil)
+	r.bondID = "ZZBL12345"
+
+	if err := r.syncDevices(context.Background()); err == nil {
+		t.Fatalf("expected an error getting the device's commands")
+	}
+	if len(mqttClient.subscribed) != 0 {
+		t.Errorf("expected the device's topics to be unsubscribed from but got %v", mqttClient.subscribed)
+	}
+
+	bridge.failing = false
+	if err := r.syncDevices(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, topic := range []string{"bondhome/devices/aabbccdd/TurnOn", "bondhome/devices/aabbccdd/commands/dim_up"} {
+		if !mqttClient.subscribed[topic] {
+			t.Errorf("expected a subscription to %s", topic)
+		}
+	}
+	const discoveryTopic = "homeassistant/fan/ZZBL12345/aabbccdd/config"
+	if mqttClient.published[discoveryTopic] == "" {
+		t.Errorf("expected a discovery config to be published to %s", discoveryTopic)
+	}
+}
+
+func Test_relay_remove(t *testing.T) {
+	cfg := config.Default()
+	mqttClient := newFakeMQTT()
+	bridge := &fakeBridge{devices: map[string]*bondhome.Device{
+		"aabbccdd": {Name: "Fan", Type: "CF", Actions: []string{"TurnOn", "TurnOff"}},
+	}}
+	r := newRelay(cfg, mqttClient, bridge, fakePush{})
+	r.bondID = "ZZBL12345"
+
+	// Start got as far as setting up the devices and a group
+	if err := r.syncDevices(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	noop := func(context.Context, []byte) error { return nil }
+	if err := r.subscribeGroup(context.Background(), r.groupTopic("11223344", "TurnOn"), noop); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	r.remove()
+	if len(mqttClient.subscribed) != 0 {
+		t.Errorf("expected every topic to be unsubscribed from but got %v", mqttClient.subscribed)
+	}
+	for _, topic := range []string{"homeassistant/fan/ZZBL12345/aabbccdd/config", "bondhome/devices/aabbccdd/state"} {
+		if payload, ok := mqttClient.published[topic]; !ok || payload != "" {
+			t.Errorf("expected the retained message of %s to be cleared but was %q", topic, payload)
+		}
+	}
+	if status := mqttClient.published["bondhome/bridge/status"]; status != "offline" {
+		t.Errorf("expected the bridge to be marked offline but was %q", status)
+	}
+}
@@ -0,0 +1,109 @@
+// Package discovery finds Bond bridges on the local network via mDNS
+package discovery
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/hashicorp/mdns"
+)
+
+const (
+	// Service is the mDNS service type that Bond bridges advertise
+	Service = "_bond._tcp"
+
+	// DefaultTimeout is how long to wait for bridges to respond
+	// to a query, which they normally do within a few milliseconds
+	DefaultTimeout = 2 * time.Second
+)
+
+// Bridge is a Bond bridge that responded to an mDNS query
+type Bridge struct {
+	// ID is the Bond ID of the bridge, e.g. ZZBL12345
+	ID string
+	// Address is the IP address of the bridge
+	Address string
+	// Port is the port of the bridge's local HTTP API
+	Port int
+}
+
+// Browse queries the local network for Bond bridges,
+// returning those that respond within the timeout
+func Browse(timeout time.Duration) ([]Bridge, error) {
+	return browse(Service, timeout)
+}
+
+// Resolve returns the IP address of the bridge with the given Bond ID
+func Resolve(bondID string, timeout time.Duration) (string, error) {
+	bridges, err := Browse(timeout)
+	if err != nil {
+		return "", err
+	}
+	for _, b := range bridges {
+		if strings.EqualFold(b.ID, bondID) {
+			glog.V(1).Infof("Resolved Bond bridge %q to %s", bondID, b.Address)
+			return b.Address, nil
+		}
+	}
+	return "", fmt.Errorf("no Bond bridge with ID %q found on the local network", bondID)
+}
+
+func browse(service string, timeout time.Duration) ([]Bridge, error) {
+	// The query doesn't block on sending entries, so leave room for plenty of bridges
+	entries := make(chan *mdns.ServiceEntry, 32)
+
+	params := mdns.DefaultParams(service)
+	params.Entries = entries
+	params.Timeout = timeout
+	// Bond bridges are only reachable over IPv4
+	params.DisableIPv6 = true
+
+	err := mdns.Query(params)
+	close(entries)
+	if err != nil {
+		return nil, fmt.Errorf("error querying mDNS for %s: %w", service, err)
+	}
+
+	var bridges []Bridge
+	seen := make(map[string]bool)
+	for e := range entries {
+		b, ok := bridgeFromEntry(service, e)
+		if !ok {
+			glog.Warningf("Ignoring mDNS response without a Bond ID or address: %+v", e)
+			continue
+		}
+		if !seen[b.ID] {
+			seen[b.ID] = true
+			bridges = append(bridges, b)
+		}
+	}
+	return bridges, nil
+}
+
+// bridgeFromEntry converts a service entry, whose instance
+// name is the Bond ID of the bridge, to a Bridge
+func bridgeFromEntry(service string, e *mdns.ServiceEntry) (Bridge, bool) {
+	i := strings.Index(e.Name, "."+service+".")
+	if i <= 0 {
+		return Bridge{}, false
+	}
+
+	var address net.IP
+	switch {
+	case e.AddrV4 != nil:
+		address = e.AddrV4
+	case e.AddrV6 != nil:
+		address = e.AddrV6
+	default:
+		return Bridge{}, false
+	}
+
+	return Bridge{
+		ID:      e.Name[:i],
+		Address: address.String(),
+		Port:    e.Port,
+	}, true
+}
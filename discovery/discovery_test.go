@@ -0,0 +1,50 @@
+package discovery
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/mdns"
+)
+
+func Test_bridgeFromEntry(t *testing.T) {
+	tests := []struct {
+		name     string
+		entry    *mdns.ServiceEntry
+		expected Bridge
+		ok       bool
+	}{
+		{
+			name:     "IPv4 address",
+			entry:    &mdns.ServiceEntry{Name: "ZZBL12345._bond._tcp.local.", AddrV4: net.IPv4(192, 168, 1, 2), Port: 80},
+			expected: Bridge{ID: "ZZBL12345", Address: "192.168.1.2", Port: 80},
+			ok:       true,
+		},
+		{
+			name:     "IPv6 address",
+			entry:    &mdns.ServiceEntry{Name: "ZZBL12345._bond._tcp.local.", AddrV6: net.ParseIP("fe80::1"), Port: 80},
+			expected: Bridge{ID: "ZZBL12345", Address: "fe80::1", Port: 80},
+			ok:       true,
+		},
+		{
+			name:  "no address",
+			entry: &mdns.ServiceEntry{Name: "ZZBL12345._bond._tcp.local.", Port: 80},
+		},
+		{
+			name:  "other service",
+			entry: &mdns.ServiceEntry{Name: "printer._ipp._tcp.local.", AddrV4: net.IPv4(192, 168, 1, 3)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual, ok := bridgeFromEntry(Service, tt.entry)
+			if ok != tt.ok {
+				t.Fatalf("expected ok=%v but was %v", tt.ok, ok)
+			}
+			if !reflect.DeepEqual(actual, tt.expected) {
+				t.Fatalf("expected %+v but was %+v", tt.expected, actual)
+			}
+		})
+	}
+}
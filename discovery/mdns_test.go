@@ -0,0 +1,45 @@
+//go:build network_test
+// +build network_test
+
+package discovery
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/mdns"
+)
+
+// testService is advertised instead of Service so
+// that real bridges on the network don't interfere
+const testService = "_bondtest._tcp"
+
+// startResponder advertises a bridge with the given
+// Bond ID and address until the test completes
+func startResponder(t *testing.T, bondID string, address net.IP) {
+	t.Helper()
+	zone, err := mdns.NewMDNSService(bondID, testService, "", bondID+".local.", 80, []net.IP{address}, []string{"Bond bridge"})
+	if err != nil {
+		t.Fatalf("error creating mDNS service: %v", err)
+	}
+	server, err := mdns.NewServer(&mdns.Config{Zone: zone})
+	if err != nil {
+		t.Fatalf("error starting mDNS responder: %v", err)
+	}
+	t.Cleanup(func() { server.Shutdown() })
+}
+
+func Test_browse(t *testing.T) {
+	startResponder(t, "ZZBL12345", net.IPv4(127, 0, 0, 2))
+
+	bridges, err := browse(testService, 500*time.Millisecond)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := Bridge{ID: "ZZBL12345", Address: "127.0.0.2", Port: 80}
+	if len(bridges) != 1 || bridges[0] != expected {
+		t.Fatalf("expected [%+v] but got %+v", expected, bridges)
+	}
+}
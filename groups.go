@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/golang/glog"
+	"github.com/ssmall/bondhome-mqtt/bondhome"
+	"golang.org/x/sync/errgroup"
+)
+
+// groupPrefix returns the prefix of the group's topics
+func (r *relay) groupPrefix(groupID string) string {
+	fields := r.bridgeFields()
+	fields.GroupID = groupID
+	return r.cfg.Topics.Group.Render(fields)
+}
+
+func (r *relay) groupTopic(groupID string, suffix string) string {
+	return r.groupPrefix(groupID) + "/" + suffix
+}
+
+// setupGroupHandlers subscribes to the actions of each of the bridge's
+// groups, mirroring the topics of devices under the group's prefix
+func (r *relay) setupGroupHandlers(ctx context.Context) error {
+	groups, err := r.bridge.GetGroupIDs(ctx)
+	if err != nil {
+		// Groups are optional, and older firmware doesn't support them
+		glog.Warningf("Unable to get groups from bridge %q: %v", r.bondID, err)
+		return nil
+	}
+
+	glog.Infoln("Got group IDs: ", groups)
+
+	var g errgroup.Group
+
+	for _, groupID := range groups {
+		localGroupID := groupID
+		g.Go(func() error {
+			group, err := r.bridge.GetGroup(ctx, localGroupID)
+			if err != nil {
+				return err
+			}
+			glog.Infof("Discovered group with id %q: %#v", localGroupID, group)
+
+			for _, actionID := range group.Actions {
+				if err := r.groupActionHandler(ctx, localGroupID, actionID, group.Actions); err != nil {
+					return err
+				}
+			}
+			if err := r.groupDispatchHandler(ctx, localGroupID, group.Actions); err != nil {
+				return err
+			}
+
+			state, err := r.bridge.GetGroupState(ctx, localGroupID)
+			if err != nil {
+				glog.Errorf("Unable to get state of group %q: %v", localGroupID, err)
+				return nil
+			}
+			r.publishState(r.groupTopic(localGroupID, "state"), state)
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		return fmt.Errorf("error setting up group listeners: %w", err)
+	}
+	return nil
+}
+
+func (r *relay) groupActionHandler(ctx context.Context, groupID string, actionID string, actions []string) error {
+	topic := r.groupTopic(groupID, actionID)
+	return r.subscribeGroup(ctx, topic, r.reportResult(topic, func(ctx context.Context, payload []byte) error {
+		action, err := bondhome.ParseAction(actionID, payload)
+		if err != nil {
+			return err
+		}
+		if err := action.Validate(actions, nil); err != nil {
+			return err
+		}
+
+		if err := bondhome.ExecuteGroup(ctx, r.bridge, groupID, action); err != nil {
+			return fmt.Errorf("error executing group action: %w", err)
+		}
+		return nil
+	}))
+}
+
+// groupDispatchHandler subscribes to a topic that executes whichever
+// of the group's actions is named by the message payload
+func (r *relay) groupDispatchHandler(ctx context.Context, groupID string, actions []string) error {
+	topic := r.groupTopic(groupID, dispatchAction)
+	return r.subscribeGroup(ctx, topic, r.reportResult(topic, func(ctx context.Context, payload []byte) error {
+		action := dispatchedAction(payload)
+		if err := action.Validate(actions, nil); err != nil {
+			return err
+		}
+
+		if err := bondhome.ExecuteGroup(ctx, r.bridge, groupID, action); err != nil {
+			return fmt.Errorf("error executing group action: %w", err)
+		}
+		return nil
+	}))
+}
+
+// subscribeGroup subscribes to one of the topics of a group,
+// which is unsubscribed from if the bridge is removed
+func (r *relay) subscribeGroup(ctx context.Context, topic string, handle func(ctx context.Context, payload []byte) error) error {
+	if err := r.subscribe(ctx, topic, handle); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.groupSubscriptions = append(r.groupSubscriptions, topic)
+	r.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// bridgeInfo is published to the bridge's info topic whenever it changes
+type bridgeInfo struct {
+	BondID          string `json:"bond_id"`
+	Make            string `json:"make"`
+	Model           string `json:"model"`
+	Target          string `json:"target"`
+	FirmwareVersion string `json:"fw_ver"`
+	FirmwareDate    string `json:"fw_date"`
+	API             int    `json:"api"`
+}
+
+// bridgeHealth is published to the bridge's health topic each time it is polled
+type bridgeHealth struct {
+	// Uptime is the number of seconds since the bridge booted
+	Uptime int64 `json:"uptime_s"`
+	// RSSI is the Wi-Fi signal strength, in dBm, if it could be retrieved
+	RSSI *int   `json:"rssi,omitempty"`
+	SSID string `json:"ssid,omitempty"`
+	// Diagnostics are the bridge's diagnostic counters, if they could be retrieved
+	Diagnostics json.RawMessage `json:"diagnostics,omitempty"`
+}
+
+func (r *relay) bridgeInfoTopic() string {
+	return r.bridgeTopic("info")
+}
+
+func (r *relay) bridgeHealthTopic() string {
+	return r.bridgeTopic("health")
+}
+
+// pollBridgeHealth publishes the bridge's info and health
+// now and then at every interval, until ctx is done
+func (r *relay) pollBridgeHealth(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// info and uptime are those last published, to detect changes
+	var info []byte
+	var uptime int64
+
+	for {
+		info, uptime = r.publishBridgeHealth(ctx, info, uptime)
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// publishBridgeHealth publishes the bridge's health, and its info if it has
+// changed since lastInfo, returning the info and uptime that were published
+func (r *relay) publishBridgeHealth(ctx context.Context, lastInfo []byte, lastUptime int64) ([]byte, int64) {
+	version, err := r.bridge.GetVersion(ctx)
+	if err != nil {
+		glog.Errorf("Unable to get version of Bond bridge %q: %v", r.bondID, err)
+		return lastInfo, lastUptime
+	}
+
+	info, err := json.Marshal(bridgeInfo{
+		BondID:          version.BondID,
+		Make:            version.Make,
+		Model:           version.Model,
+		Target:          version.Target,
+		FirmwareVersion: version.FirmwareVersion,
+		FirmwareDate:    version.FirmwareDate,
+		API:             version.API,
+	})
+	if err != nil {
+		glog.Errorln("Unable to marshal bridge info to JSON", err)
+		return lastInfo, lastUptime
+	}
+	if !bytes.Equal(info, lastInfo) {
+		if lastInfo != nil {
+			glog.Warningf("Info of Bond bridge %q changed to %s", r.bondID, info)
+		}
+		r.publishRetained(r.bridgeInfoTopic(), info)
+	}
+
+	if version.Uptime < lastUptime {
+		glog.Warningf("Bond bridge %q rebooted %s ago", r.bondID, time.Duration(version.Uptime)*time.Second)
+	}
+
+	health := bridgeHealth{Uptime: version.Uptime}
+	if wifi, err := r.bridge.GetWiFiStatus(ctx); err != nil {
+		glog.Warningf("Unable to get Wi-Fi status of Bond bridge %q: %v", r.bondID, err)
+	} else {
+		health.RSSI = &wifi.RSSI
+		health.SSID = wifi.SSID
+	}
+	if diagnostics, err := r.bridge.GetDiagnostics(ctx); err != nil {
+		glog.V(1).Infof("Unable to get diagnostics of Bond bridge %q: %v", r.bondID, err)
+	} else {
+		health.Diagnostics = diagnostics
+	}
+
+	payload, err := json.Marshal(health)
+	if err != nil {
+		glog.Errorln("Unable to marshal bridge health to JSON", err)
+		return info, version.Uptime
+	}
+	r.publishRetained(r.bridgeHealthTopic(), payload)
+
+	return info, version.Uptime
+}
+
+func (r *relay) publishRetained(topic string, payload []byte) {
+	glog.V(1).Infof("Publishing to %s with body: %s", topic, payload)
+	policy := r.cfg.MQTT.MetadataPolicy()
+	token := r.mqtt.Publish(topic, policy.QoS, policy.Retain, payload)
+	if token.Wait() && token.Error() != nil {
+		glog.Errorf("Unable to publish to topic %s: %v", topic, token.Error())
+	}
+}
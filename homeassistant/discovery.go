@@ -0,0 +1,289 @@
+// Package homeassistant builds the payloads used to announce Bond devices to
+// Home Assistant via MQTT discovery. See https://www.home-assistant.io/integrations/mqtt/#mqtt-discovery
+package homeassistant
+
+import (
+	"fmt"
+
+	"github.com/ssmall/bondhome-mqtt/bondhome"
+)
+
+const (
+	manufacturer = "Bond"
+
+	// defaultMaxSpeed is the speed range advertised for fans
+	// whose maximum speed is not known
+	defaultMaxSpeed = 3
+
+	// argumentTemplate wraps an entity's value as the argument of a Bond action
+	argumentTemplate = `{"argument": {{ value }}}`
+)
+
+// DeviceTopics holds the MQTT topics used to control and observe a single Bond device
+type DeviceTopics struct {
+	// Action returns the topic that triggers the given action
+	Action func(actionID string) string
+	// Dispatch is the topic that triggers the action named by the message payload
+	Dispatch string
+	// State is the topic that device state is published to
+	State string
+	// Availability lists topics that must all be "online"
+	// for the device to be considered available
+	Availability []string
+}
+
+// Availability is a topic that Home Assistant
+// checks to determine whether an entity is available
+type Availability struct {
+	Topic string `json:"topic"`
+}
+
+// Device identifies the Home Assistant device that an entity belongs to
+type Device struct {
+	Identifiers   []string `json:"identifiers"`
+	Name          string   `json:"name"`
+	Manufacturer  string   `json:"manufacturer"`
+	Model         string   `json:"model,omitempty"`
+	SuggestedArea string   `json:"suggested_area,omitempty"`
+}
+
+// Config is the discovery payload of a single entity. Only the fields
+// relevant to the entity's component are populated.
+type Config struct {
+	Name     string `json:"name"`
+	UniqueID string `json:"unique_id"`
+	Device   Device `json:"device"`
+
+	Availability     []Availability `json:"availability,omitempty"`
+	AvailabilityMode string         `json:"availability_mode,omitempty"`
+
+	CommandTopic string `json:"command_topic,omitempty"`
+	PayloadOn    string `json:"payload_on,omitempty"`
+	PayloadOff   string `json:"payload_off,omitempty"`
+	PayloadOpen  string `json:"payload_open,omitempty"`
+	PayloadClose string `json:"payload_close,omitempty"`
+	PayloadStop  string `json:"payload_stop,omitempty"`
+	PayloadPress string `json:"payload_press,omitempty"`
+
+	StateTopic         string `json:"state_topic,omitempty"`
+	StateValueTemplate string `json:"state_value_template,omitempty"`
+	ValueTemplate      string `json:"value_template,omitempty"`
+	StateOn            string `json:"state_on,omitempty"`
+	StateOff           string `json:"state_off,omitempty"`
+
+	PercentageCommandTopic    string `json:"percentage_command_topic,omitempty"`
+	PercentageCommandTemplate string `json:"percentage_command_template,omitempty"`
+	PercentageStateTopic      string `json:"percentage_state_topic,omitempty"`
+	PercentageValueTemplate   string `json:"percentage_value_template,omitempty"`
+	SpeedRangeMin             int    `json:"speed_range_min,omitempty"`
+	SpeedRangeMax             int    `json:"speed_range_max,omitempty"`
+
+	BrightnessCommandTopic    string `json:"brightness_command_topic,omitempty"`
+	BrightnessCommandTemplate string `json:"brightness_command_template,omitempty"`
+	BrightnessStateTopic      string `json:"brightness_state_topic,omitempty"`
+	BrightnessValueTemplate   string `json:"brightness_value_template,omitempty"`
+	BrightnessScale           int    `json:"brightness_scale,omitempty"`
+
+	SetPositionTopic    string `json:"set_position_topic,omitempty"`
+	SetPositionTemplate string `json:"set_position_template,omitempty"`
+	PositionTopic       string `json:"position_topic,omitempty"`
+	PositionTemplate    string `json:"position_template,omitempty"`
+}
+
+// Entity is a single Home Assistant entity derived from a Bond device
+type Entity struct {
+	// Component is the Home Assistant integration handling the entity, e.g. "fan"
+	Component string
+	// NodeID groups the entities of one Bond bridge
+	NodeID string
+	// ObjectID identifies the entity within the node
+	ObjectID string
+	Config   Config
+}
+
+// DiscoveryTopic returns the topic that the entity's config
+// should be published to, given the discovery prefix
+func (e Entity) DiscoveryTopic(prefix string) string {
+	return fmt.Sprintf("%s/%s/%s/%s/config", prefix, e.Component, e.NodeID, e.ObjectID)
+}
+
+// Entities returns the Home Assistant entities for a Bond device, based on
+// its type and the actions it supports. Unsupported device types yield no entities.
+// The device's properties may be nil if they are unknown.
+func Entities(bondID string, deviceID string, d *bondhome.Device, properties *bondhome.DeviceProperties, topics DeviceTopics) []Entity {
+	b := builder{
+		bondID:   bondID,
+		deviceID: deviceID,
+		device:   d,
+		maxSpeed: defaultMaxSpeed,
+		topics:   topics,
+		actions:  make(map[string]bool, len(d.Actions)),
+	}
+	if properties != nil && properties.MaxSpeed > 0 {
+		b.maxSpeed = properties.MaxSpeed
+	}
+	for _, a := range d.Actions {
+		b.actions[a] = true
+	}
+
+	var entities []Entity
+	switch d.Type {
+	case "CF": // ceiling fan
+		if e, ok := b.fan(); ok {
+			entities = append(entities, e)
+		}
+		if e, ok := b.light("light", "TurnLightOn", "TurnLightOff", deviceID+"_light", d.Name+" Light"); ok {
+			entities = append(entities, e)
+		}
+	case "MS": // motorized shades
+		if e, ok := b.cover(); ok {
+			entities = append(entities, e)
+		}
+	case "FP": // fireplace
+		if e, ok := b.fireplace(); ok {
+			entities = append(entities, e)
+		}
+	case "LT": // light
+		if e, ok := b.light("power", "TurnOn", "TurnOff", deviceID, d.Name); ok {
+			entities = append(entities, e)
+		}
+	case "GX": // generic device
+		entities = append(entities, b.buttons()...)
+	}
+	return entities
+}
+
+type builder struct {
+	bondID   string
+	deviceID string
+	device   *bondhome.Device
+	maxSpeed int
+	topics   DeviceTopics
+	actions  map[string]bool
+}
+
+func (b *builder) entity(component string, objectID string, name string) Entity {
+	var availability []Availability
+	for _, topic := range b.topics.Availability {
+		availability = append(availability, Availability{Topic: topic})
+	}
+	var availabilityMode string
+	if len(availability) > 1 {
+		availabilityMode = "all"
+	}
+
+	return Entity{
+		Component: component,
+		NodeID:    b.bondID,
+		ObjectID:  objectID,
+		Config: Config{
+			Name:     name,
+			UniqueID: fmt.Sprintf("bondhome_%s_%s", b.bondID, objectID),
+			Device: Device{
+				Identifiers:   []string{fmt.Sprintf("bondhome_%s_%s", b.bondID, b.deviceID)},
+				Name:          b.device.Name,
+				Manufacturer:  manufacturer,
+				Model:         b.device.Type,
+				SuggestedArea: b.device.Location,
+			},
+			Availability:     availability,
+			AvailabilityMode: availabilityMode,
+		},
+	}
+}
+
+// stateTemplate renders the on/off payload matching the given field of the device state
+func stateTemplate(field string, on string, off string) string {
+	return fmt.Sprintf(`{{ "%s" if value_json.%s == 1 else "%s" }}`, on, field, off)
+}
+
+func (b *builder) fan() (Entity, bool) {
+	if !b.actions["TurnOn"] || !b.actions["TurnOff"] {
+		return Entity{}, false
+	}
+	e := b.entity("fan", b.deviceID, b.device.Name)
+	e.Config.CommandTopic = b.topics.Dispatch
+	e.Config.PayloadOn = "TurnOn"
+	e.Config.PayloadOff = "TurnOff"
+	e.Config.StateTopic = b.topics.State
+	e.Config.StateValueTemplate = stateTemplate("power", "TurnOn", "TurnOff")
+	if b.actions["SetSpeed"] {
+		e.Config.PercentageCommandTopic = b.topics.Action("SetSpeed")
+		e.Config.PercentageCommandTemplate = argumentTemplate
+		e.Config.PercentageStateTopic = b.topics.State
+		e.Config.PercentageValueTemplate = "{{ value_json.speed }}"
+		e.Config.SpeedRangeMin = 1
+		e.Config.SpeedRangeMax = b.maxSpeed
+	}
+	return e, true
+}
+
+func (b *builder) light(field string, on string, off string, objectID string, name string) (Entity, bool) {
+	if !b.actions[on] || !b.actions[off] {
+		return Entity{}, false
+	}
+	e := b.entity("light", objectID, name)
+	e.Config.CommandTopic = b.topics.Dispatch
+	e.Config.PayloadOn = on
+	e.Config.PayloadOff = off
+	e.Config.StateTopic = b.topics.State
+	e.Config.StateValueTemplate = stateTemplate(field, on, off)
+	if b.actions["SetBrightness"] {
+		e.Config.BrightnessCommandTopic = b.topics.Action("SetBrightness")
+		e.Config.BrightnessCommandTemplate = argumentTemplate
+		e.Config.BrightnessStateTopic = b.topics.State
+		e.Config.BrightnessValueTemplate = "{{ value_json.brightness }}"
+		e.Config.BrightnessScale = 100
+	}
+	return e, true
+}
+
+func (b *builder) cover() (Entity, bool) {
+	if !b.actions["Open"] || !b.actions["Close"] {
+		return Entity{}, false
+	}
+	e := b.entity("cover", b.deviceID, b.device.Name)
+	e.Config.CommandTopic = b.topics.Dispatch
+	e.Config.PayloadOpen = "Open"
+	e.Config.PayloadClose = "Close"
+	if b.actions["Hold"] {
+		e.Config.PayloadStop = "Hold"
+	}
+	e.Config.StateTopic = b.topics.State
+	e.Config.ValueTemplate = `{{ "open" if value_json.open == 1 else "closed" }}`
+	if b.actions["SetPosition"] {
+		// Bond positions count from 0 (open) to 100 (closed),
+		// which is the reverse of Home Assistant's
+		e.Config.SetPositionTopic = b.topics.Action("SetPosition")
+		e.Config.SetPositionTemplate = `{"argument": {{ 100 - position }}}`
+		e.Config.PositionTopic = b.topics.State
+		e.Config.PositionTemplate = "{{ 100 - value_json.position }}"
+	}
+	return e, true
+}
+
+func (b *builder) fireplace() (Entity, bool) {
+	if !b.actions["TurnOn"] || !b.actions["TurnOff"] {
+		return Entity{}, false
+	}
+	e := b.entity("switch", b.deviceID, b.device.Name)
+	e.Config.CommandTopic = b.topics.Dispatch
+	e.Config.PayloadOn = "TurnOn"
+	e.Config.PayloadOff = "TurnOff"
+	e.Config.StateTopic = b.topics.State
+	e.Config.ValueTemplate = stateTemplate("power", "ON", "OFF")
+	e.Config.StateOn = "ON"
+	e.Config.StateOff = "OFF"
+	return e, true
+}
+
+func (b *builder) buttons() []Entity {
+	entities := make([]Entity, 0, len(b.device.Actions))
+	for _, a := range b.device.Actions {
+		e := b.entity("button", b.deviceID+"_"+a, b.device.Name+" "+a)
+		e.Config.CommandTopic = b.topics.Action(a)
+		e.Config.PayloadPress = "{}"
+		entities = append(entities, e)
+	}
+	return entities
+}
@@ -0,0 +1,158 @@
+package homeassistant
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ssmall/bondhome-mqtt/bondhome"
+)
+
+const (
+	bondID   = "ZZBL12345"
+	deviceID = "aabbccdd"
+)
+
+var testTopics = DeviceTopics{
+	Action: func(actionID string) string {
+		return "bondhome/devices/" + deviceID + "/" + actionID
+	},
+	Dispatch:     "bondhome/devices/" + deviceID + "/action",
+	State:        "bondhome/devices/" + deviceID + "/state",
+	Availability: []string{"bondhome/status", "bondhome/bridge/status"},
+}
+
+func components(entities []Entity) []string {
+	c := make([]string, 0, len(entities))
+	for _, e := range entities {
+		c = append(c, e.Component)
+	}
+	return c
+}
+
+func Test_Entities_components(t *testing.T) {
+	tests := []struct {
+		name     string
+		device   bondhome.Device
+		expected []string
+	}{
+		{
+			name: "ceiling fan with light",
+			device: bondhome.Device{Type: "CF", Actions: []string{
+				"TurnOn", "TurnOff", "SetSpeed", "TurnLightOn", "TurnLightOff", "SetBrightness",
+			}},
+			expected: []string{"fan", "light"},
+		},
+		{
+			name:     "ceiling fan without light",
+			device:   bondhome.Device{Type: "CF", Actions: []string{"TurnOn", "TurnOff", "SetSpeed"}},
+			expected: []string{"fan"},
+		},
+		{
+			name:     "shades",
+			device:   bondhome.Device{Type: "MS", Actions: []string{"Open", "Close", "Hold"}},
+			expected: []string{"cover"},
+		},
+		{
+			name:     "fireplace",
+			device:   bondhome.Device{Type: "FP", Actions: []string{"TurnOn", "TurnOff", "TogglePower"}},
+			expected: []string{"switch"},
+		},
+		{
+			name:     "light",
+			device:   bondhome.Device{Type: "LT", Actions: []string{"TurnOn", "TurnOff"}},
+			expected: []string{"light"},
+		},
+		{
+			name:     "generic device",
+			device:   bondhome.Device{Type: "GX", Actions: []string{"TogglePower", "Stop"}},
+			expected: []string{"button", "button"},
+		},
+		{
+			name:     "unsupported type",
+			device:   bondhome.Device{Type: "BD", Actions: []string{"TurnOn", "TurnOff"}},
+			expected: []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual := components(Entities(bondID, deviceID, &tt.device, nil, testTopics))
+			if !reflect.DeepEqual(actual, tt.expected) {
+				t.Fatalf("expected components %v but got %v", tt.expected, actual)
+			}
+		})
+	}
+}
+
+func Test_Entities_fan(t *testing.T) {
+	d := &bondhome.Device{
+		Name:     "Bedroom Fan",
+		Type:     "CF",
+		Location: "Bedroom",
+		Actions:  []string{"TurnOn", "TurnOff", "SetSpeed"},
+	}
+
+	entities := Entities(bondID, deviceID, d, nil, testTopics)
+	if len(entities) != 1 {
+		t.Fatalf("expected 1 entity but got %d", len(entities))
+	}
+	e := entities[0]
+
+	expectedTopic := "homeassistant/fan/ZZBL12345/aabbccdd/config"
+	if actual := e.DiscoveryTopic("homeassistant"); actual != expectedTopic {
+		t.Errorf("expected discovery topic %q but got %q", expectedTopic, actual)
+	}
+
+	if e.Config.CommandTopic != testTopics.Dispatch {
+		t.Errorf("expected command topic %q but got %q", testTopics.Dispatch, e.Config.CommandTopic)
+	}
+	if e.Config.PercentageCommandTopic != testTopics.Action("SetSpeed") {
+		t.Errorf("expected percentage command topic %q but got %q", testTopics.Action("SetSpeed"), e.Config.PercentageCommandTopic)
+	}
+	if e.Config.Device.SuggestedArea != "Bedroom" {
+		t.Errorf("expected suggested area %q but got %q", "Bedroom", e.Config.Device.SuggestedArea)
+	}
+
+	payload, err := json.Marshal(e.Config)
+	if err != nil {
+		t.Fatalf("error marshaling config: %v", err)
+	}
+	for _, key := range []string{`"unique_id":"bondhome_ZZBL12345_aabbccdd"`, `"payload_on":"TurnOn"`, `"speed_range_max":3`, `"availability_mode":"all"`} {
+		if !strings.Contains(string(payload), key) {
+			t.Errorf("expected config to contain %s but was: %s", key, payload)
+		}
+	}
+	if strings.Contains(string(payload), "brightness") {
+		t.Errorf("expected config to omit unused brightness fields but was: %s", payload)
+	}
+}
+
+func Test_Entities_fanMaxSpeed(t *testing.T) {
+	d := &bondhome.Device{Name: "Bedroom Fan", Type: "CF", Actions: []string{"TurnOn", "TurnOff", "SetSpeed"}}
+
+	entities := Entities(bondID, deviceID, d, &bondhome.DeviceProperties{MaxSpeed: 6}, testTopics)
+	if len(entities) != 1 {
+		t.Fatalf("expected 1 entity but got %d", len(entities))
+	}
+	if actual := entities[0].Config.SpeedRangeMax; actual != 6 {
+		t.Fatalf("expected speed range max 6 but got %d", actual)
+	}
+}
+
+func Test_Entities_buttons(t *testing.T) {
+	d := &bondhome.Device{Name: "Remote", Type: "GX", Actions: []string{"TogglePower"}}
+
+	entities := Entities(bondID, deviceID, d, nil, testTopics)
+	if len(entities) != 1 {
+		t.Fatalf("expected 1 entity but got %d", len(entities))
+	}
+
+	expectedTopic := "homeassistant/button/ZZBL12345/aabbccdd_TogglePower/config"
+	if actual := entities[0].DiscoveryTopic("homeassistant"); actual != expectedTopic {
+		t.Errorf("expected discovery topic %q but got %q", expectedTopic, actual)
+	}
+	if actual := entities[0].Config.CommandTopic; actual != testTopics.Action("TogglePower") {
+		t.Errorf("expected command topic %q but got %q", testTopics.Action("TogglePower"), actual)
+	}
+}
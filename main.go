@@ -2,175 +2,444 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang/glog"
 
 	"github.com/ssmall/bondhome-mqtt/bondhome"
+	"github.com/ssmall/bondhome-mqtt/config"
+	"github.com/ssmall/bondhome-mqtt/discovery"
+	"github.com/ssmall/bondhome-mqtt/metrics"
 	"github.com/ssmall/bondhome-mqtt/mqtt"
-	"golang.org/x/sync/errgroup"
 
 	paho "github.com/eclipse/paho.mqtt.golang"
 )
 
+const (
+	// minRelayBackoff and maxRelayBackoff bound the delay between attempts
+	// to relay a bridge that couldn't be relayed at startup
+	minRelayBackoff = 5 * time.Second
+	maxRelayBackoff = 5 * time.Minute
+)
+
+// errDuplicateBridge is returned for a bridge with the same Bond ID as one relayed already
+var errDuplicateBridge = errors.New("bridge is already relayed")
+
+// settingFlags are command-line flags that override settings from the config file
+var settingFlags = []struct {
+	name   string
+	usage  string
+	isBool bool
+	apply  func(c *config.Config, value string) error
+}{
+	{
+		name:  "broker",
+		usage: "The broker to connect to; see https://godoc.org/github.com/eclipse/paho.mqtt.golang#ClientOptions.AddBroker",
+		apply: func(c *config.Config, v string) error { c.MQTT.Broker = v; return nil },
+	},
+	{
+		name:  "bridge",
+		usage: "The hostname or IP address of the Bond Home bridge; overrides the first bridge in the config file",
+		apply: func(c *config.Config, v string) error { b := c.FirstBridge(); b.Address, b.ID = v, ""; return nil },
+	},
+	{
+		name:  "bridge_id",
+		usage: "The Bond ID of the Bond Home bridge, e.g. ZZBL12345, to find its address via mDNS instead of specifying -bridge; overrides the first bridge in the config file",
+		apply: func(c *config.Config, v string) error { b := c.FirstBridge(); b.ID, b.Address = v, ""; return nil },
+	},
+	{
+		name:  "token",
+		usage: "The Bond Home bridge API token; overrides the first bridge in the config file. See http://docs-local.appbond.com/#section/Getting-Started/Getting-the-Bond-Token",
+		apply: func(c *config.Config, v string) error { c.FirstBridge().Token = v; return nil },
+	},
+	{
+		name:  "discovery_prefix",
+		usage: "The topic prefix for Home Assistant MQTT discovery; set to empty to disable discovery (default \"" + config.DefaultDiscoveryPrefix + "\")",
+		apply: func(c *config.Config, v string) error { c.DiscoveryPrefix = v; return nil },
+	},
+	{
+		name:   "state_fields",
+		usage:  "Also publish each field of a device's state to its own subtopic, e.g. .../state/speed",
+		isBool: true,
+		apply: func(c *config.Config, v string) error {
+			stateFields, err := strconv.ParseBool(v)
+			c.StateFields = stateFields
+			return err
+		},
+	},
+	{
+		name:  "mqtt_username",
+		usage: "The username to authenticate to the broker with",
+		apply: func(c *config.Config, v string) error { c.MQTT.Username = v; return nil },
+	},
+	{
+		name:  "mqtt_password",
+		usage: "The password to authenticate to the broker with; prefer -mqtt_password_file or the BONDHOME_MQTT_PASSWORD environment variable",
+		apply: func(c *config.Config, v string) error { c.MQTT.Password, c.MQTT.PasswordFile = v, ""; return nil },
+	},
+	{
+		name:  "mqtt_password_file",
+		usage: "A file containing the password to authenticate to the broker with",
+		apply: func(c *config.Config, v string) error { c.MQTT.PasswordFile, c.MQTT.Password = v, ""; return nil },
+	},
+	{
+		name:  "mqtt_ca",
+		usage: "A PEM bundle of certificate authorities to verify the broker's certificate with, instead of the system's",
+		apply: func(c *config.Config, v string) error { c.MQTT.TLS.CAFile = v; return nil },
+	},
+	{
+		name:  "mqtt_cert",
+		usage: "A PEM client certificate for authenticating to the broker with mutual TLS",
+		apply: func(c *config.Config, v string) error { c.MQTT.TLS.CertFile = v; return nil },
+	},
+	{
+		name:  "mqtt_key",
+		usage: "The PEM private key matching -mqtt_cert",
+		apply: func(c *config.Config, v string) error { c.MQTT.TLS.KeyFile = v; return nil },
+	},
+	{
+		name:   "mqtt_insecure_skip_verify",
+		usage:  "Skip verification of the broker's TLS certificate; for testing only",
+		isBool: true,
+		apply: func(c *config.Config, v string) error {
+			insecure, err := strconv.ParseBool(v)
+			c.MQTT.TLS.InsecureSkipVerify = insecure
+			return err
+		},
+	},
+}
+
 func main() {
-	brokerAddress := flag.String("broker", "", "The broker to connect to; see https://godoc.org/github.com/eclipse/paho.mqtt.golang#ClientOptions.AddBroker")
-	bridgeAddress := flag.String("bridge", "", "The hostname or IP address of the Bond Home bridge")
-	bridgeToken := flag.String("token", "", "The Bond Home bridge API token. See http://docs-local.appbond.com/#section/Getting-Started/Getting-the-Bond-Token")
+	configFile := flag.String("config", "", "A YAML configuration file; flags and environment variables take precedence over its settings")
+	discover := flag.Bool("discover", false, "List the Bond Home bridges found on the local network via mDNS and exit")
+	for _, f := range settingFlags {
+		if f.isBool {
+			flag.Bool(f.name, false, f.usage)
+		} else {
+			flag.String(f.name, "", f.usage)
+		}
+	}
 	flag.Parse()
 
-	if *brokerAddress == "" {
-		glog.Fatal("Must specify broker!")
-	}
-	if *bridgeAddress == "" {
-		glog.Fatal("Must specify bridge!")
+	if *discover {
+		listBridges()
+		return
 	}
-	if *bridgeToken == "" {
-		glog.Fatal("Must specify token!")
+
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		glog.Fatal(err)
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	mqttClient, err := mqtt.NewClient(*brokerAddress)
-
+	mqttPassword, err := cfg.MQTT.ResolvePassword()
 	if err != nil {
-		glog.Fatalf("Unable to connect to MQTT broker: %v", err)
+		glog.Fatal("Unable to read MQTT password: ", err)
 	}
 
-	glog.Infoln("Connected to broker @ ", *brokerAddress)
+	if cfg.MetricsAddress != "" {
+		if err := metrics.Serve(ctx, cfg.MetricsAddress); err != nil {
+			glog.Fatalf("Unable to serve metrics: %v", err)
+		}
+	}
 
-	bridge := bondhome.NewBridge(*bridgeAddress, *bridgeToken)
+	mqttOptions := []mqtt.Option{
+		mqtt.WithAvailability(statusTopic(cfg)),
+		mqtt.WithTLS(mqtt.TLSConfig{
+			CAFile:             cfg.MQTT.TLS.CAFile,
+			CertFile:           cfg.MQTT.TLS.CertFile,
+			KeyFile:            cfg.MQTT.TLS.KeyFile,
+			InsecureSkipVerify: cfg.MQTT.TLS.InsecureSkipVerify,
+		}),
+	}
 
-	err = setupDeviceActionHandlers(ctx, bridge, mqttClient)
-	if err != nil {
-		glog.Fatal("Exiting due to error:", err)
+	if cfg.MQTT.ManualAck {
+		mqttOptions = append(mqttOptions, mqtt.WithManualAcks())
 	}
 
-	pushClient, err := bondhome.NewClient(ctx, *bridgeAddress+":30007")
-	if err != nil {
-		glog.Fatal("Exiting due to error:", err)
+	if cfg.MQTT.Version == config.MQTTv5 {
+		mqttOptions = append(mqttOptions, mqtt.WithMQTT5())
 	}
 
-	err = setupDeviceStateHandlers(ctx, pushClient, mqttClient)
+	if cfg.MQTT.Username != "" {
+		mqttOptions = append(mqttOptions, mqtt.WithCredentials(cfg.MQTT.Username, mqttPassword))
+	}
+
+	mqttClient, err := mqtt.NewClient(cfg.MQTT.Broker, mqttOptions...)
+
 	if err != nil {
-		glog.Fatal("Exiting due to error:", err)
+		glog.Fatalf("Unable to connect to MQTT broker: %v", err)
 	}
 
+	glog.Infoln("Connected to broker @ ", cfg.MQTT.Broker)
+
+	relays := &bridgeRelays{cfg: cfg, mqtt: mqttClient, bondIDs: make(map[string]string, len(cfg.Bridges))}
+	retrying := 0
+	for _, bridgeConfig := range cfg.Bridges {
+		err := relays.start(ctx, bridgeConfig)
+		if err == nil {
+			continue
+		}
+		// Keep relaying the other bridges, which may be healthy
+		glog.Errorf("Not relaying bridge @ %s: %v", bridgeConfig, err)
+		if retryable(err) {
+			retrying++
+			go relays.retry(ctx, bridgeConfig)
+		}
+	}
+	if relays.count() == 0 && retrying == 0 {
+		glog.Fatalf("Exiting since none of the %d bridges could be relayed", len(cfg.Bridges))
+	}
+	// Messages redelivered for topics that haven't been subscribed to again by now,
+	// including those of bridges being retried, are left over from the last session
+	mqtt.ReleaseHeld(mqttClient)
+
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, os.Kill)
 	s := <-c
 	glog.Warningf("Got %s, exiting", s)
+
+	// Abandon requests to bridges that are in flight, and stop relaying
+	cancel()
+	relays.stop()
+	if err := mqtt.PublishAvailability(mqttClient, statusTopic(cfg), mqtt.Offline); err != nil {
+		glog.Errorln("Unable to publish availability:", err)
+	}
+	mqttClient.Disconnect(250)
+}
+
+// bridgeRelays are the relays of the configured bridges, which are started in
+// the background if they can't be at startup, e.g. because a bridge is booting
+type bridgeRelays struct {
+	cfg  *config.Config
+	mqtt paho.Client
+
+	mu       sync.Mutex
+	relaying []*relay
+	// bondIDs maps the Bond IDs of the bridges relayed, or being started,
+	// to their config, so that two relays never subscribe to the same topics
+	bondIDs map[string]string
+	stopped bool
 }
 
-func setupDeviceStateHandlers(ctx context.Context, pushClient bondhome.PushClient, mqttClient paho.Client) error {
-	err := pushClient.StartListening()
+// start connects to a bridge and starts relaying it, unless its Bond ID is that of
+// another bridge. If starting it fails, the bridge is marked as unavailable.
+func (rs *bridgeRelays) start(ctx context.Context, bridgeConfig config.Bridge) error {
+	r, err := rs.relayBridge(ctx, bridgeConfig)
+	if errors.Is(err, errDuplicateBridge) {
+		// The status topic is that of the other bridge
+		return err
+	}
 	if err != nil {
+		rs.publishOffline(bridgeConfig)
 		return err
 	}
 
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			default:
-				update, err := pushClient.Receive(10 * time.Second)
-				if err != nil {
-					if e, ok := err.(bondhome.Timeout); !ok {
-						panic(fmt.Errorf("error receiving from Bond Bridge: %w", e))
-					}
-				}
-				if update != nil && update.Topic != "" {
-					topic := "bondhome/" + update.Topic
-					body, err := update.Body.MarshalJSON()
-					if err != nil {
-						glog.Errorln("Unable to marshal update body to JSON", err)
-					}
-					glog.V(1).Infof("Publishing to %s with body: %v", topic, string(body))
-					token := mqttClient.Publish(topic, byte(0), false, string(body))
-					if token.Wait() && token.Error() != nil {
-						glog.Errorf("Unable to publish to topic %s: %v", topic, token.Error())
-					}
-				} else if update != nil && update.ErrorMsg != "" {
-					glog.Errorf("Got error response from Bond Home bridge: code %d %q", update.ErrorID, update.ErrorMsg)
-				}
-			}
-		}
-	}()
-
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.stopped {
+		r.stop()
+		return fmt.Errorf("stopped while starting to relay bridge")
+	}
+	rs.relaying = append(rs.relaying, r)
+	glog.Infof("Relaying bridge %q @ %s", r.bondID, bridgeConfig)
 	return nil
 }
 
-func setupDeviceActionHandlers(ctx context.Context, bridge bondhome.Bridge, mqttClient paho.Client) error {
-	devices, err := bridge.GetDeviceIDs()
+// retry starts relaying a bridge that couldn't be relayed, backing off
+// exponentially until it succeeds, fails for good or ctx is done
+func (rs *bridgeRelays) retry(ctx context.Context, bridgeConfig config.Bridge) {
+	backoff := minRelayBackoff
+	for {
+		glog.Infof("Retrying to relay bridge @ %s in %s", bridgeConfig, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+
+		err := rs.start(ctx, bridgeConfig)
+		if err == nil {
+			return
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		glog.Errorf("Not relaying bridge @ %s: %v", bridgeConfig, err)
+		if !retryable(err) {
+			return
+		}
 
-	if err != nil {
-		return fmt.Errorf("could not get devices from bridge: %w", err)
+		backoff *= 2
+		if backoff > maxRelayBackoff {
+			backoff = maxRelayBackoff
+		}
 	}
+}
 
-	glog.Infoln("Got device IDs: ", devices)
+// retryable reports whether a bridge that couldn't be relayed may be later,
+// which isn't the case if its configuration is wrong
+func retryable(err error) bool {
+	return !errors.Is(err, errDuplicateBridge) && !errors.Is(err, bondhome.ErrUnauthorized)
+}
 
-	var g errgroup.Group
+func (rs *bridgeRelays) count() int {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return len(rs.relaying)
+}
 
-	for _, deviceID := range devices {
-		localDeviceID := deviceID
-		g.Go(func() error {
-			d, err := bridge.GetDevice(localDeviceID)
-			if err != nil {
-				return err
-			}
-			glog.Infof("Discovered device with id %q: %#v", localDeviceID, d)
+// stop stops every relay, including any that are started later
+func (rs *bridgeRelays) stop() {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.stopped = true
+	for _, r := range rs.relaying {
+		r.stop()
+	}
+}
 
-			var hg errgroup.Group
+// publishOffline marks a bridge that couldn't be relayed as unavailable, if the
+// topic is known, which needs its Bond ID if topics are namespaced by bridge
+func (rs *bridgeRelays) publishOffline(bridgeConfig config.Bridge) {
+	r := newRelay(rs.cfg, rs.mqtt, nil, nil)
+	// Bond IDs are upper case, but may be configured in any case
+	r.bondID = strings.ToUpper(bridgeConfig.ID)
+	if r.bondID == "" && rs.cfg.NamespaceByBridge() {
+		return
+	}
+	if err := mqtt.PublishAvailability(rs.mqtt, r.bridgeStatusTopic(), mqtt.Offline); err != nil {
+		glog.Errorln("Unable to publish availability:", err)
+	}
+}
 
-			for _, actionID := range d.Actions {
-				localActionID := actionID
-				hg.Go(func() error {
-					return actionHandler(mqttClient, bridge, localDeviceID, localActionID)
-				})
-			}
+// relayBridge connects to a bridge and starts relaying it, unless its Bond ID is
+// that of another bridge. Its Bond ID is claimed before anything is subscribed to,
+// and released again if starting to relay it fails, in which case whatever was
+// set up is removed.
+func (rs *bridgeRelays) relayBridge(ctx context.Context, bridgeConfig config.Bridge) (*relay, error) {
+	bridge, pushClient, err := connectBridge(ctx, rs.cfg, bridgeConfig)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to bridge: %w", err)
+	}
 
-			return hg.Wait()
-		})
+	r := newRelay(rs.cfg, rs.mqtt, bridge, pushClient)
+	if err := r.connect(); err != nil {
+		pushClient.StopListening()
+		return nil, fmt.Errorf("error listening for updates from bridge: %w", err)
+	}
+	if err := rs.claim(r.bondID, bridgeConfig); err != nil {
+		pushClient.StopListening()
+		return nil, err
 	}
 
-	err = g.Wait()
+	err = r.start(ctx)
+	if errors.Is(err, bondhome.ErrUnauthorized) {
+		err = fmt.Errorf("bridge rejected its token, check that it is the bridge's local API token: %w", err)
+	}
 	if err != nil {
-		return fmt.Errorf("error setting up listeners: %w", err)
+		r.remove()
+		rs.release(r.bondID)
+		return nil, err
 	}
+	return r, nil
+}
+
+// claim records the Bond ID of a bridge that is being started,
+// unless it is that of another bridge
+func (rs *bridgeRelays) claim(bondID string, bridgeConfig config.Bridge) error {
+	if bondID == "" {
+		// Only possible with a single bridge
+		return nil
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if other, ok := rs.bondIDs[bondID]; ok {
+		return fmt.Errorf("bridge @ %s has the same Bond ID %q: %w", other, bondID, errDuplicateBridge)
+	}
+	rs.bondIDs[bondID] = bridgeConfig.String()
 	return nil
 }
 
-func actionHandler(mqtt paho.Client, bridge bondhome.Bridge, deviceID string, actionID string) error {
-	topic := fmt.Sprintf("bondhome/devices/%s/%s", deviceID, actionID)
+func (rs *bridgeRelays) release(bondID string) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	delete(rs.bondIDs, bondID)
+}
 
-	token := mqtt.Subscribe(topic, byte(0), func(c paho.Client, m paho.Message) {
-		glog.V(1).Infof("Message(%d): %q on topic %s", m.MessageID(), m.Payload(), m.Topic())
+// connectBridge creates the API and push clients for a bridge, whose requests
+// are limited and retried as configured. Bridges that are configured by ID are
+// found via mDNS, and are looked up again whenever they can't be reached, in
+// case their address has changed.
+func connectBridge(ctx context.Context, cfg *config.Config, b config.Bridge) (bondhome.Bridge, bondhome.PushClient, error) {
+	opts := []bondhome.Option{
+		bondhome.WithTimeout(cfg.RequestTimeout),
+		bondhome.WithRetries(cfg.RequestRetries, bondhome.DefaultRetryBackoff),
+	}
+	if b.ID == "" {
+		pushClient, err := bondhome.NewClient(ctx, b.Address+":30007")
+		return bondhome.NewBridge(b.Address, b.Token, opts...), pushClient, err
+	}
 
-		payload := m.Payload()
-		if err := json.Unmarshal(payload, &map[string]interface{}{}); err != nil {
-			glog.V(1).Infof("Message payload %q is not an object (unmarshaling error was: %s), will be wrapped as object", payload, err)
-			payload = []byte(fmt.Sprintf("{\"body\": %s}", payload))
-		}
+	resolve := func() (string, error) {
+		return discovery.Resolve(b.ID, discovery.DefaultTimeout)
+	}
 
-		if err := bridge.ExecuteAction(deviceID, actionID, string(payload)); err != nil {
-			glog.Errorf("Not acking message due to error executing action: %v\n", err)
-		} else {
-			m.Ack()
-		}
-	})
+	bridge, err := bondhome.NewResolvingBridge(resolve, b.Token, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	pushClient, err := bondhome.NewResolvingClient(ctx, resolve)
+	return bridge, pushClient, err
+}
 
-	if token.Wait() && token.Error() != nil {
-		return fmt.Errorf("unable to subscribe to topic %s: %w", topic, token.Error())
+// listBridges prints the ID and address of each bridge found on the local network
+func listBridges() {
+	bridges, err := discovery.Browse(discovery.DefaultTimeout)
+	if err != nil {
+		glog.Fatal("Unable to discover bridges: ", err)
+	}
+	if len(bridges) == 0 {
+		fmt.Println("No Bond Home bridges found")
+		return
+	}
+	for _, b := range bridges {
+		fmt.Printf("%s\t%s\n", b.ID, b.Address)
 	}
+}
 
-	glog.Infoln("Subcribed to topic", topic)
+// loadConfig loads the config file, if any, applies overrides
+// from command-line flags and validates the result
+func loadConfig(path string) (*config.Config, error) {
+	cfg, err := config.Load(path)
+	if err != nil {
+		return nil, err
+	}
 
-	return nil
+	setFlags := make(map[string]string)
+	flag.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = f.Value.String()
+	})
+	for _, f := range settingFlags {
+		if v, ok := setFlags[f.name]; ok {
+			if err := f.apply(cfg, v); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
 }
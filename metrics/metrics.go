@@ -0,0 +1,151 @@
+// Package metrics collects metrics about the bridges and the broker,
+// which can be served to Prometheus over HTTP
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	namespace = "bondhome"
+
+	shutdownTimeout = 5 * time.Second
+)
+
+var (
+	// BPUPPacketsReceived counts the packets received from each bridge over BPUP
+	BPUPPacketsReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "bpup_packets_received_total",
+		Help:      "BPUP packets received from the bridge.",
+	}, []string{"bond_id"})
+	// BPUPPacketsParsed counts the packets received over BPUP that were
+	// parsed successfully, by the topic of the update they carried
+	BPUPPacketsParsed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "bpup_packets_parsed_total",
+		Help:      "BPUP packets parsed successfully, by topic.",
+	}, []string{"bond_id", "topic"})
+	// BPUPPacketsFailed counts the packets received over BPUP that couldn't
+	// be parsed, which therefore have no topic
+	BPUPPacketsFailed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "bpup_packets_failed_total",
+		Help:      "BPUP packets that couldn't be parsed.",
+	}, []string{"bond_id"})
+	// BPUPReconnectAttempts counts the attempts to re-establish the BPUP connection
+	// to a bridge after it was lost, e.g. because the bridge stopped responding to
+	// keep-alives
+	BPUPReconnectAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "bpup_reconnect_attempts_total",
+		Help:      "Attempts to reconnect to the bridge after the BPUP connection was lost.",
+	}, []string{"bond_id"})
+
+	// APIRequestDuration observes each attempt of a request to a bridge's
+	// local API, by endpoint, method and response status, or "error" if
+	// there was no response
+	APIRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "api_request_duration_seconds",
+		Help:      "Latency of requests to the bridge's local API.",
+		Buckets:   []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"endpoint", "method", "status"})
+	// ActionsExecuted counts the actions executed on each device, by
+	// whether the bridge accepted them ("success") or not ("error")
+	ActionsExecuted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "actions_executed_total",
+		Help:      "Actions executed on devices, by device, action and result.",
+	}, []string{"device_id", "action", "result"})
+
+	// MQTTPublishFailures counts the messages that couldn't be published to the broker
+	MQTTPublishFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "mqtt_publish_failures_total",
+		Help:      "Messages that couldn't be published to the MQTT broker.",
+	})
+	// MQTTConnected is 1 while connected to the broker and 0 otherwise
+	MQTTConnected = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "mqtt_connected",
+		Help:      "Whether the MQTT broker is connected.",
+	})
+	// BridgeConnected is 1 while a bridge is responding to BPUP keep-alives and 0 otherwise
+	BridgeConnected = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "bridge_connected",
+		Help:      "Whether the bridge is responding to BPUP keep-alives.",
+	}, []string{"bond_id"})
+)
+
+var registry = prometheus.NewRegistry()
+
+func init() {
+	registry.MustRegister(
+		BPUPPacketsReceived,
+		BPUPPacketsParsed,
+		BPUPPacketsFailed,
+		BPUPReconnectAttempts,
+		APIRequestDuration,
+		ActionsExecuted,
+		MQTTPublishFailures,
+		MQTTConnected,
+		BridgeConnected,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// SetConnected sets a connection state gauge to 1 if connected and 0 otherwise
+func SetConnected(g prometheus.Gauge, connected bool) {
+	if connected {
+		g.Set(1)
+	} else {
+		g.Set(0)
+	}
+}
+
+// Handler serves the metrics in the Prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// Serve listens on addr, e.g. ":9090", and serves the metrics on
+// /metrics in the background until ctx is done
+func Serve(ctx context.Context, addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("error listening on %s: %w", addr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			glog.Errorln("Error serving metrics:", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			glog.Errorln("Error stopping metrics server:", err)
+		}
+	}()
+
+	glog.Infof("Serving metrics on http://%s/metrics", listener.Addr())
+	return nil
+}
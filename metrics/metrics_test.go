@@ -0,0 +1,32 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_Handler(t *testing.T) {
+	MQTTPublishFailures.Inc()
+	SetConnected(BridgeConnected.WithLabelValues("ZZBL12345"), true)
+	APIRequestDuration.WithLabelValues("/v2/devices/{id}", http.MethodGet, "200").Observe(0.05)
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200 but got %d", rec.Code)
+	}
+
+	body := rec.Body.String()
+	for _, expected := range []string{
+		"bondhome_mqtt_publish_failures_total 1",
+		`bondhome_bridge_connected{bond_id="ZZBL12345"} 1`,
+		`bondhome_api_request_duration_seconds_count{endpoint="/v2/devices/{id}",method="GET",status="200"} 1`,
+		"go_goroutines",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("expected metrics to contain %q but got:\n%s", expected, body)
+		}
+	}
+}
@@ -1,22 +1,145 @@
 package mqtt
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"os"
 	"time"
 
 	"github.com/golang/glog"
 
+	"github.com/ssmall/bondhome-mqtt/metrics"
+
 	paho "github.com/eclipse/paho.mqtt.golang"
 )
 
 const (
 	connectTimeout = 10 * time.Second
+
+	// Online is published to availability topics while the publisher is available
+	Online = "online"
+	// Offline is published to availability topics once the publisher becomes unavailable
+	Offline = "offline"
+
+	availabilityQoS = byte(1)
 )
 
+// Option configures the client created by NewClient
+type Option func(*paho.ClientOptions) error
+
+// TLSConfig describes how to secure the connection to the broker
+type TLSConfig struct {
+	// CAFile is a PEM bundle of certificate authorities to trust
+	// instead of the system's; optional
+	CAFile string
+	// CertFile and KeyFile are the PEM-encoded client certificate
+	// and key used for mutual TLS; optional
+	CertFile string
+	KeyFile  string
+	// InsecureSkipVerify disables verification of the broker's
+	// certificate. It should only be used for testing.
+	InsecureSkipVerify bool
+}
+
+// WithCredentials authenticates to the broker with a username and password
+func WithCredentials(username string, password string) Option {
+	return func(opts *paho.ClientOptions) error {
+		opts.SetUsername(username)
+		opts.SetPassword(password)
+		return nil
+	}
+}
+
+// WithTLS secures the connection to the broker. It only takes effect
+// for brokers with a TLS scheme, e.g. ssl://<host>:8883
+func WithTLS(config TLSConfig) Option {
+	return func(opts *paho.ClientOptions) error {
+		tlsConfig, err := newTLSConfig(config)
+		if err != nil {
+			return err
+		}
+		opts.SetTLSConfig(tlsConfig)
+		return nil
+	}
+}
+
+func newTLSConfig(config TLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+
+	if config.CAFile != "" {
+		pem, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CA file: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %q", config.CAFile)
+		}
+	}
+
+	if config.CertFile != "" || config.KeyFile != "" {
+		if config.CertFile == "" || config.KeyFile == "" {
+			return nil, fmt.Errorf("client certificate and key must be specified together")
+		}
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// WithAvailability publishes a retained Online message to the given topic
+// every time the client (re)connects, and registers a last-will message so
+// that the broker publishes a retained Offline message to the same topic
+// if the client disconnects unexpectedly
+func WithAvailability(topic string) Option {
+	return func(opts *paho.ClientOptions) error {
+		opts.SetWill(topic, Offline, availabilityQoS, true)
+		opts.SetOnConnectHandler(func(c paho.Client) {
+			// Handlers must not block on tokens, so publish in the background
+			go func() {
+				if err := PublishAvailability(c, topic, Online); err != nil {
+					glog.Errorln("Unable to publish availability:", err)
+				}
+			}()
+		})
+		return nil
+	}
+}
+
+// WithManualAcks stops messages from being acknowledged automatically once they
+// have been handled, leaving that to the handler, and resumes the client's session
+// on reconnecting, so that the broker redelivers messages that weren't acknowledged.
+// Messages redelivered before their topic is subscribed to again are handled once
+// it is. It only affects subscriptions with a QoS of 1 or 2.
+func WithManualAcks() Option {
+	return func(opts *paho.ClientOptions) error {
+		opts.SetAutoAckDisabled(true)
+		opts.SetCleanSession(false)
+		return nil
+	}
+}
+
+// WithMQTT5 connects to the broker with MQTT 5 rather than 3.1.1, so that
+// messages may ask to be replied to, see Request. It can't be combined with
+// WithManualAcks, since the client starts a clean session on every connection.
+func WithMQTT5() Option {
+	return func(opts *paho.ClientOptions) error {
+		opts.ProtocolVersion = protocolVersion5
+		return nil
+	}
+}
+
 // NewClient creates a new MQTT client and tries to establish
-// a connection to the specified broker
-func NewClient(broker string) (paho.Client, error) {
+// a connection to the specified broker. Messages may be handled
+// concurrently, and not necessarily in the order they arrive.
+func NewClient(broker string, options ...Option) (paho.Client, error) {
 	clientID, err := os.Hostname()
 	if err != nil {
 		return nil, err
@@ -25,10 +148,85 @@ func NewClient(broker string) (paho.Client, error) {
 	opts := paho.NewClientOptions()
 	opts.AddBroker(broker)
 	opts.SetClientID(clientID)
-	client := paho.NewClient(opts)
+	// Handle each message in its own goroutine, so that handlers can wait for
+	// their requests to the bridge and their publications to complete without
+	// holding up other messages or the client's keep-alives
+	opts.SetOrderMatters(false)
+	for _, o := range options {
+		if err := o(opts); err != nil {
+			return nil, err
+		}
+	}
+	trackConnection(opts)
+
+	var client paho.Client
+	switch {
+	case opts.ProtocolVersion == protocolVersion5:
+		if !opts.CleanSession {
+			return nil, errV5ManualAcks
+		}
+		client = newV5Client(opts)
+	case opts.CleanSession:
+		client = paho.NewClient(opts)
+	default:
+		// Hold the messages that the broker redelivers on connecting
+		// until they can be handled, see resumingClient
+		resuming := holdUnrouted(opts)
+		resuming.Client = paho.NewClient(opts)
+		client = resuming
+	}
+
 	connectToken := client.Connect()
 	if !connectToken.WaitTimeout(connectTimeout) {
 		return nil, fmt.Errorf("timed out after %v", connectTimeout)
 	}
-	return client, nil
+	if err := connectToken.Error(); err != nil {
+		return nil, err
+	}
+	return &countingClient{client}, nil
+}
+
+// trackConnection records whether the client is connected to the
+// broker in metrics, alongside any handlers set by options
+func trackConnection(opts *paho.ClientOptions) {
+	onConnect, onConnectionLost := opts.OnConnect, opts.OnConnectionLost
+	opts.SetOnConnectHandler(func(c paho.Client) {
+		metrics.SetConnected(metrics.MQTTConnected, true)
+		if onConnect != nil {
+			onConnect(c)
+		}
+	})
+	opts.SetConnectionLostHandler(func(c paho.Client, err error) {
+		metrics.SetConnected(metrics.MQTTConnected, false)
+		if onConnectionLost != nil {
+			onConnectionLost(c, err)
+		}
+	})
+}
+
+// countingClient counts the messages that fail to be published in metrics,
+// whether or not the caller waits for them to be published
+type countingClient struct {
+	paho.Client
+}
+
+func (c *countingClient) Publish(topic string, qos byte, retained bool, payload interface{}) paho.Token {
+	token := c.Client.Publish(topic, qos, retained, payload)
+	go func() {
+		<-token.Done()
+		if token.Error() != nil {
+			metrics.MQTTPublishFailures.Inc()
+		}
+	}()
+	return token
+}
+
+// PublishAvailability publishes a retained availability
+// message (Online or Offline) to the given topic
+func PublishAvailability(client paho.Client, topic string, availability string) error {
+	token := client.Publish(topic, availabilityQoS, true, availability)
+	if token.Wait() && token.Error() != nil {
+		return fmt.Errorf("unable to publish to topic %s: %w", topic, token.Error())
+	}
+	return nil
 }
@@ -0,0 +1,323 @@
+package mqtt
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/packets"
+	paho5 "github.com/eclipse/paho.golang/paho"
+	paho "github.com/eclipse/paho.mqtt.golang"
+)
+
+// writeTestCertificate writes a self-signed certificate and its
+// key to a temporary directory and returns their paths
+func writeTestCertificate(t *testing.T) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "bondhome-mqtt test"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("error creating certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("error marshaling key: %v", err)
+	}
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("error writing certificate: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatalf("error writing key: %v", err)
+	}
+	return certFile, keyFile
+}
+
+func Test_newTLSConfig(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t)
+
+	c, err := newTLSConfig(TLSConfig{
+		CAFile:   certFile,
+		CertFile: certFile,
+		KeyFile:  keyFile,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if c.RootCAs == nil {
+		t.Errorf("expected root CAs to be loaded")
+	}
+	if len(c.Certificates) != 1 {
+		t.Errorf("expected 1 client certificate but got %d", len(c.Certificates))
+	}
+	if c.InsecureSkipVerify {
+		t.Errorf("expected certificate verification to be enabled")
+	}
+}
+
+func Test_newTLSConfig_errors(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t)
+
+	tests := []struct {
+		name   string
+		config TLSConfig
+	}{
+		{"missing CA file", TLSConfig{CAFile: filepath.Join(t.TempDir(), "missing.pem")}},
+		{"CA file without certificates", TLSConfig{CAFile: keyFile}},
+		{"certificate without key", TLSConfig{CertFile: certFile}},
+		{"key without certificate", TLSConfig{KeyFile: keyFile}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newTLSConfig(tt.config); err == nil {
+				t.Fatalf("expected an error but got none")
+			}
+		})
+	}
+}
+
+// fakeClient records the handler of each topic subscribed to,
+// and the topics unsubscribed from
+type fakeClient struct {
+	paho.Client
+	handlers     map[string]paho.MessageHandler
+	unsubscribed []string
+}
+
+func (c *fakeClient) Subscribe(topic string, _ byte, callback paho.MessageHandler) paho.Token {
+	c.handlers[topic] = callback
+	return nil
+}
+
+func (c *fakeClient) Unsubscribe(topics ...string) paho.Token {
+	c.unsubscribed = append(c.unsubscribed, topics...)
+	return &paho.DummyToken{}
+}
+
+type fakeMessage struct {
+	paho.Message
+	topic   string
+	payload string
+	acked   bool
+}
+
+func (m *fakeMessage) Topic() string { return m.topic }
+func (m *fakeMessage) Ack()          { m.acked = true }
+
+func Test_resumingClient(t *testing.T) {
+	opts := paho.NewClientOptions()
+	c := holdUnrouted(opts)
+	c.Client = &fakeClient{handlers: make(map[string]paho.MessageHandler)}
+
+	// The broker redelivers messages as soon as the client connects
+	opts.DefaultPublishHandler(c, &fakeMessage{topic: "bondhome/devices/1/TurnOn", payload: "first"})
+	opts.DefaultPublishHandler(c, &fakeMessage{topic: "bondhome/devices/2/TurnOn", payload: "other"})
+	opts.DefaultPublishHandler(c, &fakeMessage{topic: "bondhome/devices/1/TurnOn", payload: "second"})
+
+	handled := make(chan string, 2)
+	c.Subscribe("bondhome/devices/1/TurnOn", 1, func(_ paho.Client, m paho.Message) {
+		handled <- m.(*fakeMessage).payload
+	})
+
+	for _, expected := range []string{"first", "second"} {
+		select {
+		case actual := <-handled:
+			if actual != expected {
+				t.Errorf("expected held message %q but got %q", expected, actual)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected held message %q to be handled", expected)
+		}
+	}
+	if held := c.take("bondhome/devices/2/TurnOn"); len(held) != 1 {
+		t.Errorf("expected the message to another topic to still be held but got %d", len(held))
+	}
+}
+
+func Test_resumingClient_release(t *testing.T) {
+	opts := paho.NewClientOptions()
+	c := holdUnrouted(opts)
+	fake := &fakeClient{handlers: make(map[string]paho.MessageHandler)}
+	c.Client = fake
+
+	// A message to a topic of a device that was removed while the client was down
+	stale := &fakeMessage{topic: "bondhome/devices/1/TurnOn"}
+	opts.DefaultPublishHandler(c, stale)
+
+	ReleaseHeld(&countingClient{c})
+	if !stale.acked {
+		t.Errorf("expected the held message to be acked")
+	}
+	if !reflect.DeepEqual(fake.unsubscribed, []string{"bondhome/devices/1/TurnOn"}) {
+		t.Errorf("expected the topic of the held message to be unsubscribed from but got %v", fake.unsubscribed)
+	}
+
+	// Messages that arrive from now on aren't held
+	late := &fakeMessage{topic: "bondhome/devices/2/TurnOn"}
+	opts.DefaultPublishHandler(c, late)
+	if !late.acked {
+		t.Errorf("expected the message that arrived after releasing to be acked")
+	}
+	if held := c.take("bondhome/devices/2/TurnOn"); len(held) != 0 {
+		t.Errorf("expected no messages to be held but got %d", len(held))
+	}
+}
+
+func Test_Withhold(t *testing.T) {
+	opts := paho.NewClientOptions()
+	c := holdUnrouted(opts)
+	client := &countingClient{c}
+
+	for i := 0; i < maxWithheldMessages; i++ {
+		if !Withhold(client) {
+			t.Fatalf("expected message %d to be withheld", i+1)
+		}
+	}
+	if Withhold(client) {
+		t.Errorf("expected no more than %d messages to be withheld", maxWithheldMessages)
+	}
+
+	// The withheld messages are redelivered on reconnecting
+	opts.OnConnect(c)
+	if !Withhold(client) {
+		t.Errorf("expected messages to be withheld again after reconnecting")
+	}
+}
+
+// fakeV5Connection records the requests that a v5Client makes to the broker
+type fakeV5Connection struct {
+	mu           sync.Mutex
+	published    []*paho5.Publish
+	unsubscribed []string
+	// subscribed receives the topics of each subscribe request
+	subscribed chan []string
+}
+
+func (c *fakeV5Connection) Publish(_ context.Context, p *paho5.Publish) (*paho5.PublishResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.published = append(c.published, p)
+	return &paho5.PublishResponse{}, nil
+}
+
+func (c *fakeV5Connection) Subscribe(_ context.Context, s *paho5.Subscribe) (*paho5.Suback, error) {
+	topics := make([]string, 0, len(s.Subscriptions))
+	for topic := range s.Subscriptions {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	c.subscribed <- topics
+	return &paho5.Suback{}, nil
+}
+
+func (c *fakeV5Connection) Unsubscribe(_ context.Context, u *paho5.Unsubscribe) (*paho5.Unsuback, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.unsubscribed = append(c.unsubscribed, u.Topics...)
+	return &paho5.Unsuback{}, nil
+}
+
+func (c *fakeV5Connection) Disconnect(context.Context) error {
+	return nil
+}
+
+func Test_v5Client(t *testing.T) {
+	conn := &fakeV5Connection{subscribed: make(chan []string, 2)}
+	c := newV5Client(paho.NewClientOptions())
+	c.conn = conn
+	const topic = "bondhome/devices/1/TurnOn"
+
+	requests := make(chan Request, 1)
+	token := c.Subscribe(topic, 1, func(_ paho.Client, m paho.Message) {
+		request, ok := m.(Request)
+		if !ok {
+			t.Errorf("expected a Request but got %T", m)
+			return
+		}
+		requests <- request
+	})
+	if token.Wait() && token.Error() != nil {
+		t.Fatalf("unexpected error: %v", token.Error())
+	}
+	if subscribed := <-conn.subscribed; !reflect.DeepEqual(subscribed, []string{topic}) {
+		t.Errorf("expected a subscription to %s but got %v", topic, subscribed)
+	}
+
+	c.router.Route(&packets.Publish{
+		Topic:   topic,
+		QoS:     1,
+		Payload: []byte("on"),
+		Properties: &packets.Properties{
+			ResponseTopic:   "clients/1/replies",
+			CorrelationData: []byte("42"),
+		},
+	})
+	var request Request
+	select {
+	case request = <-requests:
+	case <-time.After(time.Second):
+		t.Fatalf("expected the message to be handled")
+	}
+	if request.ResponseTopic() != "clients/1/replies" || string(request.CorrelationData()) != "42" || string(request.Payload()) != "on" {
+		t.Errorf("unexpected request: topic %q, correlation data %q, payload %q", request.ResponseTopic(), request.CorrelationData(), request.Payload())
+	}
+
+	token = request.Reply(1, []byte(`{"success":true}`))
+	if token.Wait() && token.Error() != nil {
+		t.Fatalf("unexpected error: %v", token.Error())
+	}
+	if len(conn.published) != 1 {
+		t.Fatalf("expected a reply to be published but got %d messages", len(conn.published))
+	}
+	reply := conn.published[0]
+	if reply.Topic != "clients/1/replies" || string(reply.Properties.CorrelationData) != "42" || string(reply.Payload) != `{"success":true}` {
+		t.Errorf("unexpected reply: topic %q, correlation data %q, payload %q", reply.Topic, reply.Properties.CorrelationData, reply.Payload)
+	}
+
+	// Sessions start clean, so topics are subscribed to again on reconnecting
+	c.connectionUp()
+	select {
+	case subscribed := <-conn.subscribed:
+		if !reflect.DeepEqual(subscribed, []string{topic}) {
+			t.Errorf("expected a subscription to %s again but got %v", topic, subscribed)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected the topic to be subscribed to again")
+	}
+
+	token = c.Unsubscribe(topic)
+	if token.Wait() && token.Error() != nil {
+		t.Fatalf("unexpected error: %v", token.Error())
+	}
+	if !reflect.DeepEqual(conn.unsubscribed, []string{topic}) || len(c.subscriptions) != 0 {
+		t.Errorf("expected the topic to be unsubscribed from but got %v, %v", conn.unsubscribed, c.subscriptions)
+	}
+}
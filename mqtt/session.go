@@ -0,0 +1,195 @@
+package mqtt
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/golang/glog"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	// maxHeldMessages limits how many messages are held for topics that haven't been subscribed to
+	maxHeldMessages = 1000
+
+	// maxWithheldMessages limits how many messages may be left unacknowledged until
+	// the client reconnects. Brokers stop delivering messages to a client that has
+	// too many unacknowledged messages, e.g. 20 by default in Mosquitto (see its
+	// max_inflight_messages), so this leaves room for the messages being handled.
+	maxWithheldMessages = 10
+)
+
+// resumingClient hands messages that arrive before their topic is subscribed to
+// over to the handler of the topic once it is. When a session resumes, the broker
+// redelivers the messages that weren't acknowledged as soon as the client connects,
+// before any subscriptions have been made again, and paho would otherwise drop
+// them without acknowledging them, so that they would never be handled.
+// Messages are matched to subscriptions by their exact topic.
+type resumingClient struct {
+	paho.Client
+
+	mu sync.Mutex
+	// held are the messages that arrived for topics without a handler, in order
+	held []paho.Message
+	// released is set once messages are no longer held, see release
+	released bool
+	// withheld counts the messages left unacknowledged since the client connected
+	withheld int
+}
+
+// holdUnrouted sets the handler of messages that match no subscription so
+// that they are held by the returned client until their topic is subscribed to
+func holdUnrouted(opts *paho.ClientOptions) *resumingClient {
+	c := &resumingClient{}
+	opts.SetDefaultPublishHandler(func(_ paho.Client, m paho.Message) {
+		c.hold(m)
+	})
+	// The broker redelivers the messages that were withheld on connecting
+	onConnect := opts.OnConnect
+	opts.SetOnConnectHandler(func(client paho.Client) {
+		c.mu.Lock()
+		c.withheld = 0
+		c.mu.Unlock()
+		if onConnect != nil {
+			onConnect(client)
+		}
+	})
+	return c
+}
+
+func (c *resumingClient) hold(m paho.Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.released {
+		// The topic is left over from an earlier session
+		c.drop(m)
+		c.unsubscribe(m.Topic())
+		return
+	}
+	if len(c.held) >= maxHeldMessages {
+		c.drop(c.held[0])
+		c.held = c.held[1:]
+	}
+	glog.V(1).Infof("Holding message on topic %s until the topic is subscribed to", m.Topic())
+	c.held = append(c.held, m)
+}
+
+// drop acknowledges a message that won't be handled, so that
+// it doesn't count against the broker's limit of unacknowledged messages
+func (c *resumingClient) drop(m paho.Message) {
+	glog.Warningf("Dropping unhandled message on topic %s", m.Topic())
+	m.Ack()
+}
+
+// unsubscribe removes the subscriptions of topics that nothing handles
+// anymore from the session, without waiting for the broker to confirm it
+func (c *resumingClient) unsubscribe(topics ...string) {
+	token := c.Client.Unsubscribe(topics...)
+	go func() {
+		if token.Wait() && token.Error() != nil {
+			glog.Errorf("Unable to unsubscribe from topics %v: %v", topics, token.Error())
+		}
+	}()
+}
+
+// release drops the messages held for topics that haven't been subscribed to, and
+// unsubscribes from those topics, which are left over from an earlier session,
+// e.g. of devices that were removed since. Messages that arrive for topics that
+// aren't subscribed to are dropped from then on.
+func (c *resumingClient) release() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.released = true
+	if len(c.held) == 0 {
+		return
+	}
+
+	stale := make(map[string]bool)
+	for _, m := range c.held {
+		c.drop(m)
+		stale[m.Topic()] = true
+	}
+	c.held = nil
+
+	topics := make([]string, 0, len(stale))
+	for topic := range stale {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	c.unsubscribe(topics...)
+}
+
+// withhold records that a message is left unacknowledged, unless
+// too many are already, in which case it returns false
+func (c *resumingClient) withhold() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.withheld >= maxWithheldMessages {
+		return false
+	}
+	c.withheld++
+	return true
+}
+
+// take removes the messages held for the topic and returns them
+func (c *resumingClient) take(topic string) []paho.Message {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var taken []paho.Message
+	kept := c.held[:0]
+	for _, m := range c.held {
+		if m.Topic() == topic {
+			taken = append(taken, m)
+		} else {
+			kept = append(kept, m)
+		}
+	}
+	c.held = kept
+	return taken
+}
+
+// Subscribe subscribes to the topic and then passes any messages
+// held for it to the handler, in the order they arrived
+func (c *resumingClient) Subscribe(topic string, qos byte, callback paho.MessageHandler) paho.Token {
+	token := c.Client.Subscribe(topic, qos, callback)
+	if held := c.take(topic); len(held) > 0 {
+		go func() {
+			for _, m := range held {
+				callback(c, m)
+			}
+		}()
+	}
+	return token
+}
+
+// resuming returns the resumingClient of a client created by NewClient, if any
+func resuming(client paho.Client) (*resumingClient, bool) {
+	if c, ok := client.(*countingClient); ok {
+		client = c.Client
+	}
+	c, ok := client.(*resumingClient)
+	return c, ok
+}
+
+// ReleaseHeld drops the messages that the broker redelivered for topics that
+// haven't been subscribed to again, and unsubscribes from them, so that they don't
+// count against the broker's limit of unacknowledged messages. It should be called
+// once every topic that is handled has been subscribed to. It does nothing for
+// clients whose session isn't resumed.
+func ReleaseHeld(client paho.Client) {
+	if c, ok := resuming(client); ok {
+		c.release()
+	}
+}
+
+// Withhold reports whether a message may be left unacknowledged, so that the
+// broker redelivers it once the client reconnects. The number of such messages is
+// limited, since brokers stop delivering messages to a client that has too many;
+// once it is reached, the message should be acknowledged instead.
+func Withhold(client paho.Client) bool {
+	if c, ok := resuming(client); ok {
+		return c.withhold()
+	}
+	return true
+}
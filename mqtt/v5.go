@@ -0,0 +1,381 @@
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	paho5 "github.com/eclipse/paho.golang/paho"
+	paho "github.com/eclipse/paho.mqtt.golang"
+)
+
+// protocolVersion5 is the protocol version of MQTT 5, which paho doesn't support
+// itself, so it's set in the client options for NewClient to create a v5Client
+const protocolVersion5 = 5
+
+// errV5ManualAcks is returned by NewClient for options that enable both MQTT 5 and manual acks
+var errV5ManualAcks = errors.New("manual acks aren't supported with MQTT 5")
+
+// Request is a message that may ask to be replied to, which only messages received
+// with MQTT 5 can. Handlers of clients that use MQTT 5 are passed messages that
+// implement it.
+type Request interface {
+	paho.Message
+	// ResponseTopic is the topic to publish the reply to, or empty if
+	// the message doesn't ask to be replied to
+	ResponseTopic() string
+	// CorrelationData identifies the request to whoever made it; optional
+	CorrelationData() []byte
+	// Reply publishes payload to the response topic along with the correlation data
+	Reply(qos byte, payload []byte) paho.Token
+}
+
+// v5Connection is the part of autopaho.ConnectionManager that v5Client uses
+type v5Connection interface {
+	Publish(ctx context.Context, p *paho5.Publish) (*paho5.PublishResponse, error)
+	Subscribe(ctx context.Context, s *paho5.Subscribe) (*paho5.Suback, error)
+	Unsubscribe(ctx context.Context, u *paho5.Unsubscribe) (*paho5.Unsuback, error)
+	Disconnect(ctx context.Context) error
+}
+
+// v5Client connects to the broker with MQTT 5 rather than 3.1.1, using
+// paho.golang behind the paho.Client interface that the rest of the program
+// uses. It reconnects whenever the connection is lost, starting a clean session
+// and subscribing to its topics again each time, so messages are always
+// acknowledged once they have been handed to their handlers. Like the clients
+// created by paho with SetOrderMatters(false), it handles each message in its
+// own goroutine.
+type v5Client struct {
+	opts   *paho.ClientOptions
+	reader paho.ClientOptionsReader
+	router *paho5.StandardRouter
+
+	// ctx is cancelled once the client disconnects, which abandons its requests
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu        sync.Mutex
+	conn      v5Connection
+	connected bool
+	// subscriptions maps the topics subscribed to, to subscribe to
+	// again on reconnecting, to the QoS they were subscribed with
+	subscriptions map[string]byte
+}
+
+func newV5Client(opts *paho.ClientOptions) *v5Client {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &v5Client{
+		opts: opts,
+		// paho offers no other way to create a ClientOptionsReader,
+		// and its clients don't connect until they're told to
+		reader:        paho.NewClient(opts).OptionsReader(),
+		router:        paho5.NewStandardRouter(),
+		ctx:           ctx,
+		cancel:        cancel,
+		subscriptions: make(map[string]byte),
+	}
+}
+
+// Connect connects to the broker in the background. The token completes once the
+// client has connected or its first attempt to has failed, in which case it gives
+// up, like paho's clients do unless they're set to retry.
+func (c *v5Client) Connect() paho.Token {
+	token := newV5Token()
+	var first sync.Once
+	cfg := autopaho.ClientConfig{
+		BrokerUrls:     c.opts.Servers,
+		TlsCfg:         c.opts.TLSConfig,
+		KeepAlive:      uint16(c.opts.KeepAlive),
+		ConnectTimeout: c.opts.ConnectTimeout,
+		OnConnectionUp: func(*autopaho.ConnectionManager, *paho5.Connack) {
+			c.connectionUp()
+			first.Do(func() { token.complete(nil) })
+		},
+		OnConnectError: func(err error) {
+			failed := false
+			first.Do(func() {
+				failed = true
+				c.cancel()
+				token.complete(err)
+			})
+			if !failed {
+				glog.Warningf("Unable to reconnect to MQTT broker: %v", err)
+			}
+		},
+		ClientConfig: paho5.ClientConfig{
+			ClientID:      c.opts.ClientID,
+			Router:        c.router,
+			OnClientError: c.connectionLost,
+			OnServerDisconnect: func(d *paho5.Disconnect) {
+				c.connectionLost(fmt.Errorf("broker disconnected with reason code %d", d.ReasonCode))
+			},
+		},
+	}
+	cfg.SetUsernamePassword(c.opts.Username, []byte(c.opts.Password))
+	if c.opts.WillEnabled {
+		cfg.SetWillMessage(c.opts.WillTopic, c.opts.WillPayload, c.opts.WillQos, c.opts.WillRetained)
+	}
+
+	// Hold the lock until the connection is set, since it may come up right away
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	conn, err := autopaho.NewConnection(c.ctx, cfg)
+	if err != nil {
+		token.complete(err)
+		return token
+	}
+	c.conn = conn
+	return token
+}
+
+// connectionUp subscribes to the client's topics again, since the
+// session starts clean, and calls the options' OnConnect handler
+func (c *v5Client) connectionUp() {
+	c.mu.Lock()
+	c.connected = true
+	conn := c.conn
+	filters := make(map[string]byte, len(c.subscriptions))
+	for topic, qos := range c.subscriptions {
+		filters[topic] = qos
+	}
+	c.mu.Unlock()
+
+	if len(filters) > 0 {
+		go func() {
+			if err := subscribe(c.ctx, conn, filters); err != nil {
+				glog.Errorf("Unable to subscribe to %d topics again after reconnecting: %v", len(filters), err)
+			}
+		}()
+	}
+	if c.opts.OnConnect != nil {
+		go c.opts.OnConnect(c)
+	}
+}
+
+// connectionLost calls the options' OnConnectionLost handler,
+// once for each connection however many errors it ends with
+func (c *v5Client) connectionLost(err error) {
+	c.mu.Lock()
+	connected := c.connected
+	c.connected = false
+	c.mu.Unlock()
+
+	if connected && c.opts.OnConnectionLost != nil {
+		c.opts.OnConnectionLost(c, err)
+	}
+}
+
+func (c *v5Client) IsConnected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.connected
+}
+
+func (c *v5Client) IsConnectionOpen() bool {
+	return c.IsConnected()
+}
+
+// Disconnect waits up to quiesce milliseconds for the connection to be closed
+func (c *v5Client) Disconnect(quiesce uint) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(quiesce)*time.Millisecond)
+	defer cancel()
+	c.mu.Lock()
+	conn := c.conn
+	c.connected = false
+	c.mu.Unlock()
+
+	if conn == nil {
+		// The client never connected
+		return
+	}
+	if err := conn.Disconnect(ctx); err != nil {
+		glog.Warningf("Unable to disconnect from MQTT broker: %v", err)
+	}
+	c.cancel()
+}
+
+func (c *v5Client) Publish(topic string, qos byte, retained bool, payload interface{}) paho.Token {
+	p := &paho5.Publish{Topic: topic, QoS: qos, Retain: retained}
+	switch payload := payload.(type) {
+	case string:
+		p.Payload = []byte(payload)
+	case []byte:
+		p.Payload = payload
+	default:
+		token := newV5Token()
+		token.complete(fmt.Errorf("unknown payload type %T", payload))
+		return token
+	}
+	return c.publish(p)
+}
+
+func (c *v5Client) publish(p *paho5.Publish) paho.Token {
+	return c.request(func(ctx context.Context, conn v5Connection) error {
+		_, err := conn.Publish(ctx, p)
+		return err
+	})
+}
+
+func (c *v5Client) Subscribe(topic string, qos byte, callback paho.MessageHandler) paho.Token {
+	return c.SubscribeMultiple(map[string]byte{topic: qos}, callback)
+}
+
+func (c *v5Client) SubscribeMultiple(filters map[string]byte, callback paho.MessageHandler) paho.Token {
+	c.mu.Lock()
+	for topic, qos := range filters {
+		c.route(topic, callback)
+		c.subscriptions[topic] = qos
+	}
+	c.mu.Unlock()
+
+	return c.request(func(ctx context.Context, conn v5Connection) error {
+		return subscribe(ctx, conn, filters)
+	})
+}
+
+func subscribe(ctx context.Context, conn v5Connection, filters map[string]byte) error {
+	s := &paho5.Subscribe{Subscriptions: make(map[string]paho5.SubscribeOptions, len(filters))}
+	for topic, qos := range filters {
+		s.Subscriptions[topic] = paho5.SubscribeOptions{QoS: qos}
+	}
+	_, err := conn.Subscribe(ctx, s)
+	return err
+}
+
+func (c *v5Client) Unsubscribe(topics ...string) paho.Token {
+	c.mu.Lock()
+	for _, topic := range topics {
+		c.router.UnregisterHandler(topic)
+		delete(c.subscriptions, topic)
+	}
+	c.mu.Unlock()
+
+	return c.request(func(ctx context.Context, conn v5Connection) error {
+		_, err := conn.Unsubscribe(ctx, &paho5.Unsubscribe{Topics: topics})
+		return err
+	})
+}
+
+func (c *v5Client) AddRoute(topic string, callback paho.MessageHandler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.route(topic, callback)
+}
+
+// route hands the messages on the topic to callback, replacing any callback the
+// topic had, like paho does. The router calls callbacks one message at a time
+// and acknowledges each message once they return, so callbacks run in the
+// background.
+func (c *v5Client) route(topic string, callback paho.MessageHandler) {
+	c.router.UnregisterHandler(topic)
+	c.router.RegisterHandler(topic, func(p *paho5.Publish) {
+		go callback(c, &v5Message{publish: p, client: c})
+	})
+}
+
+func (c *v5Client) OptionsReader() paho.ClientOptionsReader {
+	return c.reader
+}
+
+// request makes a request to the broker in the background,
+// returning a token that completes once it has been made
+func (c *v5Client) request(do func(ctx context.Context, conn v5Connection) error) paho.Token {
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+
+	token := newV5Token()
+	go func() {
+		token.complete(do(c.ctx, conn))
+	}()
+	return token
+}
+
+// v5Message is a message received with MQTT 5
+type v5Message struct {
+	publish *paho5.Publish
+	client  *v5Client
+}
+
+// Duplicate always returns false, since paho.golang doesn't expose the DUP flag
+func (m *v5Message) Duplicate() bool   { return false }
+func (m *v5Message) Qos() byte         { return m.publish.QoS }
+func (m *v5Message) Retained() bool    { return m.publish.Retain }
+func (m *v5Message) Topic() string     { return m.publish.Topic }
+func (m *v5Message) MessageID() uint16 { return m.publish.PacketID }
+func (m *v5Message) Payload() []byte   { return m.publish.Payload }
+
+// Ack does nothing, since messages are acknowledged once they have been routed
+func (m *v5Message) Ack() {}
+
+func (m *v5Message) ResponseTopic() string {
+	if m.publish.Properties == nil {
+		return ""
+	}
+	return m.publish.Properties.ResponseTopic
+}
+
+func (m *v5Message) CorrelationData() []byte {
+	if m.publish.Properties == nil {
+		return nil
+	}
+	return m.publish.Properties.CorrelationData
+}
+
+func (m *v5Message) Reply(qos byte, payload []byte) paho.Token {
+	return m.client.publish(&paho5.Publish{
+		Topic:      m.ResponseTopic(),
+		QoS:        qos,
+		Payload:    payload,
+		Properties: &paho5.PublishProperties{CorrelationData: m.CorrelationData()},
+	})
+}
+
+// v5Token completes once a request to the broker has been made
+type v5Token struct {
+	done chan struct{}
+	err  error
+}
+
+func newV5Token() *v5Token {
+	return &v5Token{done: make(chan struct{})}
+}
+
+func (t *v5Token) complete(err error) {
+	t.err = err
+	close(t.done)
+}
+
+func (t *v5Token) Wait() bool {
+	<-t.done
+	return true
+}
+
+func (t *v5Token) WaitTimeout(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-t.done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (t *v5Token) Done() <-chan struct{} {
+	return t.done
+}
+
+func (t *v5Token) Error() error {
+	select {
+	case <-t.done:
+		return t.err
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,839 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/ssmall/bondhome-mqtt/bondhome"
+	"github.com/ssmall/bondhome-mqtt/config"
+	"github.com/ssmall/bondhome-mqtt/homeassistant"
+	"github.com/ssmall/bondhome-mqtt/metrics"
+	"github.com/ssmall/bondhome-mqtt/mqtt"
+	"github.com/ssmall/bondhome-mqtt/topic"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+)
+
+// dispatchAction is rendered as the {action} of the per-device topic whose payload
+// names the action to execute. Bond action names are capitalized, so it cannot
+// clash with them.
+const dispatchAction = "action"
+
+// messageTimeout limits how long handling a message from the broker may take,
+// including retries of the requests to the bridge that it causes
+const messageTimeout = time.Minute
+
+// requestCount numbers the messages handled from the broker
+var requestCount uint64
+
+// nextRequestID returns an ID for a message from the broker, which is
+// logged along with the message and the requests to the bridge it causes
+func nextRequestID() string {
+	return "mqtt-" + strconv.FormatUint(atomic.AddUint64(&requestCount, 1), 10)
+}
+
+// relay connects the devices of a single Bond bridge to the MQTT broker
+type relay struct {
+	cfg    *config.Config
+	mqtt   paho.Client
+	bridge bondhome.Bridge
+	push   bondhome.PushClient
+	// bondID identifies the bridge; it is set once the push client has connected
+	bondID string
+
+	mu sync.Mutex
+	// excluded holds the IDs of devices that are filtered out by the configuration
+	excluded map[string]bool
+	// devices holds the devices that topics are rendered for, by ID
+	devices map[string]*bondhome.Device
+	// properties holds the properties of each device that could be retrieved, by ID
+	properties map[string]*bondhome.DeviceProperties
+	// topics maps each device's rendered topics to the device's ID,
+	// to detect templates that render the same topic for different devices
+	topics map[string]string
+	// handled holds each device that has been set up or excluded, by ID,
+	// as it was at the time, to detect devices that have changed since
+	handled map[string]*bondhome.Device
+	// subscriptions holds the topics subscribed to for each device, by ID
+	subscriptions map[string][]string
+	// groupSubscriptions holds the topics subscribed to for the bridge's groups
+	groupSubscriptions []string
+	// discoveryTopics holds the Home Assistant discovery
+	// topics published for each device, by ID
+	discoveryTopics map[string][]string
+	// states holds the state last published to each state topic
+	states map[string]json.RawMessage
+	// fieldTopics holds the topics that the fields of each state
+	// topic's state have been published to, by state topic
+	fieldTopics map[string]map[string]bool
+
+	// refresh requests that the bridge's devices are listed again
+	refresh chan struct{}
+	// cancel stops whatever start left running
+	cancel context.CancelFunc
+}
+
+func newRelay(cfg *config.Config, mqttClient paho.Client, bridge bondhome.Bridge, pushClient bondhome.PushClient) *relay {
+	return &relay{
+		cfg:        cfg,
+		mqtt:       mqttClient,
+		bridge:     bridge,
+		push:       pushClient,
+		excluded:   make(map[string]bool),
+		devices:    make(map[string]*bondhome.Device),
+		properties: make(map[string]*bondhome.DeviceProperties),
+		topics:     make(map[string]string),
+
+		handled:         make(map[string]*bondhome.Device),
+		subscriptions:   make(map[string][]string),
+		discoveryTopics: make(map[string][]string),
+		states:          make(map[string]json.RawMessage),
+		fieldTopics:     make(map[string]map[string]bool),
+		refresh:         make(chan struct{}, 1),
+	}
+}
+
+// connect starts listening for updates from the bridge, which identifies
+// the bridge by its Bond ID. The caller must call stop once it succeeds.
+func (r *relay) connect() error {
+	if err := r.push.StartListening(); err != nil {
+		return err
+	}
+
+	r.bondID = r.push.BondID()
+	if r.bondID == "" && r.cfg.NamespaceByBridge() {
+		return fmt.Errorf("bridge did not report its Bond ID, which is needed to namespace its topics")
+	}
+	return nil
+}
+
+// start subscribes to device and group updates from the bridge and
+// commands from the broker. It must be called after connect.
+func (r *relay) start(ctx context.Context) error {
+	ctx, r.cancel = context.WithCancel(ctx)
+	err := r.setupDeviceStateHandlers(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = r.setupDeviceActionHandlers(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = r.setupGroupHandlers(ctx)
+	if err != nil {
+		return err
+	}
+
+	if r.cfg.HealthInterval > 0 {
+		go r.pollBridgeHealth(ctx, r.cfg.HealthInterval)
+	}
+	go r.watchDevices(ctx, r.cfg.RefreshInterval)
+	return nil
+}
+
+// stop marks the bridge as unavailable, and stops relaying it and listening for
+// updates. Its subscriptions are kept, so that a persistent session queues
+// commands for the bridge until it is relayed again; see remove.
+func (r *relay) stop() {
+	if r.cancel != nil {
+		r.cancel()
+	}
+	metrics.SetConnected(metrics.BridgeConnected.WithLabelValues(r.bondID), false)
+	if err := mqtt.PublishAvailability(r.mqtt, r.bridgeStatusTopic(), mqtt.Offline); err != nil {
+		glog.Errorln("Unable to publish availability:", err)
+	}
+	if err := r.push.StopListening(); err != nil {
+		glog.Errorln("Error stopping push client:", err)
+	}
+}
+
+// remove stops relaying the bridge after start failed, and unsubscribes from the
+// topics and clears the discovery configs and state that start got as far as
+// subscribing to and publishing, so that nothing is left that refers to handlers
+// that no longer run
+func (r *relay) remove() {
+	r.stop()
+
+	r.mu.Lock()
+	deviceIDs := make([]string, 0, len(r.handled))
+	for deviceID := range r.handled {
+		deviceIDs = append(deviceIDs, deviceID)
+	}
+	groupSubscriptions := r.groupSubscriptions
+	r.groupSubscriptions = nil
+	r.mu.Unlock()
+
+	for _, deviceID := range deviceIDs {
+		r.removeDevice(deviceID)
+	}
+	if len(groupSubscriptions) == 0 {
+		return
+	}
+	token := r.mqtt.Unsubscribe(groupSubscriptions...)
+	if token.Wait() && token.Error() != nil {
+		glog.Errorf("Unable to unsubscribe from topics of groups: %v", token.Error())
+	}
+}
+
+func statusTopic(cfg *config.Config) string {
+	return cfg.TopicPrefix + "/status"
+}
+
+// baseTopic is the prefix of all of the bridge's topics
+func (r *relay) baseTopic() string {
+	if r.cfg.NamespaceByBridge() {
+		return r.cfg.TopicPrefix + "/" + r.bondID
+	}
+	return r.cfg.TopicPrefix
+}
+
+// bridgeFields returns the values of the placeholders
+// in topic templates that are the same for every topic
+func (r *relay) bridgeFields() topic.Fields {
+	return topic.Fields{
+		Prefix: r.cfg.TopicPrefix,
+		BondID: r.bondID,
+		Base:   r.baseTopic(),
+	}
+}
+
+// bridgeTopic returns a topic of the bridge itself
+func (r *relay) bridgeTopic(suffix string) string {
+	return r.cfg.Topics.Bridge.Render(r.bridgeFields()) + "/" + suffix
+}
+
+func (r *relay) bridgeStatusTopic() string {
+	return r.bridgeTopic("status")
+}
+
+// topicFields returns the values of the placeholders in the device's topic templates
+func (r *relay) topicFields(deviceID string) topic.Fields {
+	r.mu.Lock()
+	d, ok := r.devices[deviceID]
+	r.mu.Unlock()
+	if !ok {
+		d = &bondhome.Device{}
+	}
+	return r.deviceFields(deviceID, d)
+}
+
+// deviceFields returns the values of the placeholders in the topic
+// templates of a device, whether or not it has been added
+func (r *relay) deviceFields(deviceID string, d *bondhome.Device) topic.Fields {
+	name := d.Name
+	if name == "" {
+		name = deviceID
+	}
+	fields := r.bridgeFields()
+	fields.DeviceID = deviceID
+	fields.Name = name
+	fields.Location = d.Location
+	fields.Type = d.Type
+	return fields
+}
+
+// deviceTopic returns a topic of the device that has no template of its own
+func (r *relay) deviceTopic(deviceID string, suffix string) string {
+	return r.cfg.Topics.Device.Render(r.topicFields(deviceID)) + "/" + suffix
+}
+
+func (r *relay) stateTopic(deviceID string) string {
+	return r.cfg.Topics.State.Render(r.topicFields(deviceID))
+}
+
+func (r *relay) actionTopic(deviceID string, actionID string) string {
+	fields := r.topicFields(deviceID)
+	fields.Action = actionID
+	return r.cfg.Topics.Action.Render(fields)
+}
+
+// addDevice records the device that topics are rendered for, unless its topics
+// are the same as those of a device added previously, which is an error
+func (r *relay) addDevice(deviceID string, d *bondhome.Device) error {
+	fields := r.deviceFields(deviceID, d)
+	dispatchFields := fields
+	dispatchFields.Action = dispatchAction
+	rendered := []string{
+		r.cfg.Topics.Device.Render(fields),
+		r.cfg.Topics.State.Render(fields),
+		r.cfg.Topics.Action.Render(dispatchFields),
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, t := range rendered {
+		if other, ok := r.topics[t]; ok && other != deviceID {
+			return fmt.Errorf("devices %q and %q both have topic %s; change the topic templates to tell them apart", other, deviceID, t)
+		}
+	}
+	r.devices[deviceID] = d
+	for _, t := range rendered {
+		r.topics[t] = deviceID
+	}
+	return nil
+}
+
+// updateTopic maps the topic of a BPUP update onto the configured topics. It
+// returns false for updates of devices that haven't been set up, which are
+// dropped; the device is set up on the refresh that this requests instead,
+// unless it is excluded, which publishes its current state. Updates of groups
+// and of the bridge itself are published under their templates, and any other
+// updates under the base topic.
+func (r *relay) updateTopic(bpupTopic string) (string, bool) {
+	parts := strings.SplitN(bpupTopic, "/", 3)
+	switch {
+	case parts[0] == "groups" && len(parts) == 2:
+		return r.groupPrefix(parts[1]), true
+	case parts[0] == "groups":
+		return r.groupTopic(parts[1], parts[2]), true
+	case parts[0] == "bridge":
+		return r.cfg.Topics.Bridge.Render(r.bridgeFields()) + strings.TrimPrefix(bpupTopic, "bridge"), true
+	case parts[0] != "devices" || len(parts) < 2:
+		return r.baseTopic() + "/" + bpupTopic, true
+	}
+
+	if len(parts) == 2 {
+		// The device itself was added, changed or removed
+		r.requestRefresh()
+	}
+
+	deviceID := parts[1]
+	r.mu.Lock()
+	_, known := r.devices[deviceID]
+	r.mu.Unlock()
+	if !known {
+		// The update arrived before the device was set up, or the device was added since
+		r.requestRefresh()
+		return "", false
+	}
+
+	switch {
+	case len(parts) == 2:
+		return r.cfg.Topics.Device.Render(r.topicFields(deviceID)), true
+	case parts[2] == "state":
+		return r.stateTopic(deviceID), true
+	}
+	return r.deviceTopic(deviceID, parts[2]), true
+}
+
+// isExcluded reports whether a BPUP topic belongs to a device
+// that is filtered out by the configuration
+func (r *relay) isExcluded(bpupTopic string) bool {
+	parts := strings.Split(bpupTopic, "/")
+	if len(parts) < 2 || parts[0] != "devices" {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.excluded[parts[1]]
+}
+
+func (r *relay) setupDeviceStateHandlers(ctx context.Context) error {
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case e := <-r.push.ConnectionEvents():
+				metrics.SetConnected(metrics.BridgeConnected.WithLabelValues(r.bondID), e.Connected)
+				availability := mqtt.Online
+				if e.Connected {
+					glog.Infof("Connected to push updates from Bond bridge %q", r.bondID)
+				} else {
+					glog.Warningf("Lost connection to push updates from Bond bridge %q, reconnecting: %v", r.bondID, e.Err)
+					availability = mqtt.Offline
+				}
+				if err := mqtt.PublishAvailability(r.mqtt, r.bridgeStatusTopic(), availability); err != nil {
+					glog.Errorln("Unable to publish availability:", err)
+				}
+			}
+		}
+	}()
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			default:
+				update, err := r.push.Receive(10 * time.Second)
+				if err != nil {
+					if e, ok := err.(net.Error); !ok || !e.Timeout() {
+						glog.Warningf("Error receiving from Bond bridge %q: %v", r.bondID, err)
+					}
+				}
+				if update != nil && update.Topic != "" {
+					if r.isExcluded(update.Topic) {
+						glog.V(2).Infoln("Ignoring update for excluded device on topic", update.Topic)
+						continue
+					}
+					topic, ok := r.updateTopic(update.Topic)
+					if !ok {
+						glog.V(1).Infoln("Ignoring update for device that isn't set up yet on topic", update.Topic)
+						continue
+					}
+					if strings.HasSuffix(update.Topic, "/state") {
+						r.publishState(topic, update.Body)
+						continue
+					}
+					body, err := update.Body.MarshalJSON()
+					if err != nil {
+						glog.Errorln("Unable to marshal update body to JSON", err)
+					}
+					glog.V(1).Infof("Publishing to %s with body: %v", topic, string(body))
+					token := r.mqtt.Publish(topic, r.cfg.MQTT.QoS, r.cfg.MQTT.Retain, string(body))
+					if token.Wait() && token.Error() != nil {
+						glog.Errorf("Unable to publish to topic %s: %v", topic, token.Error())
+					}
+				} else if update != nil && update.ErrorMsg != "" {
+					glog.Errorf("Got error response from Bond Home bridge: code %d %q", update.ErrorID, update.ErrorMsg)
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (r *relay) actionHandler(ctx context.Context, deviceID string, actionID string) error {
+	topic := r.actionTopic(deviceID, actionID)
+	return r.subscribeDevice(ctx, deviceID, topic, r.reportResult(topic, func(ctx context.Context, payload []byte) error {
+		action, err := bondhome.ParseAction(actionID, payload)
+		if err != nil {
+			return err
+		}
+		if err := r.validateAction(deviceID, action); err != nil {
+			return err
+		}
+
+		if err := bondhome.Execute(ctx, r.bridge, deviceID, action); err != nil {
+			return fmt.Errorf("error executing action: %w", err)
+		}
+		return nil
+	}))
+}
+
+// dispatchHandler subscribes to a topic that executes whichever of the
+// device's actions is named by the message payload. This allows a single
+// command topic to drive several actions, e.g. TurnOn and TurnOff.
+func (r *relay) dispatchHandler(ctx context.Context, deviceID string) error {
+	topic := r.actionTopic(deviceID, dispatchAction)
+	return r.subscribeDevice(ctx, deviceID, topic, r.reportResult(topic, func(ctx context.Context, payload []byte) error {
+		action := dispatchedAction(payload)
+		if err := r.validateAction(deviceID, action); err != nil {
+			return err
+		}
+
+		if err := bondhome.Execute(ctx, r.bridge, deviceID, action); err != nil {
+			return fmt.Errorf("error executing action: %w", err)
+		}
+		return nil
+	}))
+}
+
+// stateUpdateHandler subscribes to a topic that corrects the bridge's belief of
+// the device's state, without transmitting anything to the device. The payload
+// is a state object with the fields to correct, e.g. {"power": 0}.
+func (r *relay) stateUpdateHandler(ctx context.Context, deviceID string) error {
+	return r.subscribeDevice(ctx, deviceID, r.stateTopic(deviceID)+"/set", func(ctx context.Context, payload []byte) error {
+		if err := json.Unmarshal(payload, &map[string]interface{}{}); err != nil {
+			return fmt.Errorf("state %q is not an object: %w", payload, err)
+		}
+
+		if err := r.bridge.UpdateDeviceState(ctx, deviceID, string(payload)); err != nil {
+			return fmt.Errorf("error updating state: %w", err)
+		}
+		return nil
+	})
+}
+
+// subscribe subscribes to the topic, handling each message with handle. With
+// manual acks, messages whose requests to the bridge fail in a way that is safe
+// to retry (see bondhome.IsRetryable) aren't acked, so that the broker redelivers
+// them once the client reconnects, as long as there aren't too many of them (see
+// mqtt.Withhold). Other messages are acked whether handle succeeds or not, so
+// that requests that may have reached the bridge, such as toggles, aren't
+// repeated. Each message is handled with a context derived from ctx that carries
+// a request ID, to trace the requests it causes, and expires after messageTimeout.
+// Messages that ask to be replied to, which only MQTT 5 messages can (see
+// mqtt.Request), are replied to with the result of handling them.
+func (r *relay) subscribe(ctx context.Context, topic string, handle func(ctx context.Context, payload []byte) error) error {
+	token := r.mqtt.Subscribe(topic, r.cfg.MQTT.CommandPolicy().QoS, func(c paho.Client, m paho.Message) {
+		requestID := nextRequestID()
+		glog.V(1).Infof("Message(%d) [%s]: %q on topic %s", m.MessageID(), requestID, m.Payload(), m.Topic())
+
+		msgCtx, cancel := context.WithTimeout(bondhome.WithRequestID(ctx, requestID), messageTimeout)
+		defer cancel()
+
+		start := time.Now()
+		err := handle(msgCtx, m.Payload())
+		if request, ok := m.(mqtt.Request); ok && request.ResponseTopic() != "" {
+			r.reply(request, handledResult(msgCtx, m.Payload(), start, err))
+		}
+		if err != nil {
+			if r.cfg.MQTT.ManualAck && bondhome.IsRetryable(err) {
+				if mqtt.Withhold(r.mqtt) {
+					glog.Errorf("Not acking message [%s] on topic %s, so that the broker redelivers it: %v", requestID, m.Topic(), err)
+					return
+				}
+				glog.Errorf("Dropping message [%s] on topic %s since too many messages are waiting to be redelivered: %v", requestID, m.Topic(), err)
+			} else {
+				// Redelivering the message wouldn't help, e.g. because its payload is
+				// invalid, or might repeat a request that the bridge acted on
+				glog.Errorf("Dropping message [%s] on topic %s: %v", requestID, m.Topic(), err)
+			}
+		}
+		m.Ack()
+	})
+
+	if token.Wait() && token.Error() != nil {
+		return fmt.Errorf("unable to subscribe to topic %s: %w", topic, token.Error())
+	}
+
+	glog.Infoln("Subcribed to topic", topic)
+
+	return nil
+}
+
+// commandResult is the outcome of handling a message to a command topic,
+// for replying to whoever published it
+type commandResult struct {
+	Success bool `json:"success"`
+	// RequestID is the ID that the message and the requests it caused were logged with
+	RequestID string `json:"request_id,omitempty"`
+	// Payload is the payload of the message
+	Payload string `json:"payload"`
+	// LatencyMS is how long handling the message took, in milliseconds
+	LatencyMS int64 `json:"latency_ms"`
+	// Status is the HTTP status that the bridge responded to a failed request with, if any
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+func newCommandResult(err error) commandResult {
+	if err == nil {
+		return commandResult{Success: true}
+	}
+	result := commandResult{Error: err.Error()}
+	var statusErr *bondhome.StatusError
+	if errors.As(err, &statusErr) {
+		result.Status = statusErr.StatusCode
+	}
+	return result
+}
+
+// reportResult wraps the handler of a command topic so that, if command results
+// are enabled, the result of handling each message is published to <topic>/result
+func (r *relay) reportResult(topic string, handle func(ctx context.Context, payload []byte) error) func(ctx context.Context, payload []byte) error {
+	if !r.cfg.CommandResults {
+		return handle
+	}
+	return func(ctx context.Context, payload []byte) error {
+		start := time.Now()
+		err := handle(ctx, payload)
+		r.publishResult(topic+"/result", handledResult(ctx, payload, start, err))
+		return err
+	}
+}
+
+// handledResult is the result of handling a message with the given payload,
+// which started at start, with the request ID that ctx carries
+func handledResult(ctx context.Context, payload []byte, start time.Time, err error) commandResult {
+	result := newCommandResult(err)
+	result.RequestID = bondhome.RequestID(ctx)
+	result.Payload = string(payload)
+	result.LatencyMS = time.Since(start).Milliseconds()
+	return result
+}
+
+func (r *relay) publishResult(topic string, result commandResult) {
+	payload, err := json.Marshal(result)
+	if err != nil {
+		glog.Errorf("Unable to marshal result for topic %s: %v", topic, err)
+		return
+	}
+
+	glog.V(1).Infof("Publishing to %s with body: %s", topic, payload)
+	token := r.mqtt.Publish(topic, r.cfg.MQTT.CommandPolicy().QoS, false, payload)
+	if token.Wait() && token.Error() != nil {
+		glog.Errorf("Unable to publish to topic %s: %v", topic, token.Error())
+	}
+}
+
+// reply publishes the result of handling a request to its response topic
+func (r *relay) reply(request mqtt.Request, result commandResult) {
+	payload, err := json.Marshal(result)
+	if err != nil {
+		glog.Errorf("Unable to marshal reply to %s: %v", request.ResponseTopic(), err)
+		return
+	}
+
+	glog.V(1).Infof("Replying to %s with body: %s", request.ResponseTopic(), payload)
+	token := request.Reply(r.cfg.MQTT.CommandPolicy().QoS, payload)
+	if token.Wait() && token.Error() != nil {
+		glog.Errorf("Unable to reply to %s: %v", request.ResponseTopic(), token.Error())
+	}
+}
+
+// subscribeDevice subscribes to one of the device's topics,
+// which is unsubscribed from if the device is removed
+func (r *relay) subscribeDevice(ctx context.Context, deviceID string, topic string, handle func(ctx context.Context, payload []byte) error) error {
+	if err := r.subscribe(ctx, topic, handle); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.subscriptions[deviceID] = append(r.subscriptions[deviceID], topic)
+	r.mu.Unlock()
+	return nil
+}
+
+// dispatchedAction returns the action named by the payload of a message to
+// a dispatch topic, which can only name actions that take no argument
+func dispatchedAction(payload []byte) bondhome.Action {
+	return bondhome.Action{Name: strings.TrimSpace(string(payload))}
+}
+
+// validateAction checks that the device supports the action, and
+// that its argument is within range, e.g. the device's speed range
+func (r *relay) validateAction(deviceID string, action bondhome.Action) error {
+	r.mu.Lock()
+	d := r.devices[deviceID]
+	properties := r.properties[deviceID]
+	r.mu.Unlock()
+
+	if d == nil {
+		return fmt.Errorf("device %q is not set up", deviceID)
+	}
+	return action.Validate(d.Actions, properties)
+}
+
+// commandHandlers subscribes to a topic for each of the device's commands,
+// e.g. buttons learned from a remote, named after the command
+func (r *relay) commandHandlers(ctx context.Context, deviceID string) error {
+	commandIDs, err := r.bridge.GetCommandIDs(ctx, deviceID)
+	if err != nil {
+		glog.Warningf("Unable to get commands of device %q: %v", deviceID, err)
+		return nil
+	}
+
+	names := make(map[string]bool, len(commandIDs))
+	for _, commandID := range commandIDs {
+		command, err := r.bridge.GetCommand(ctx, deviceID, commandID)
+		if err != nil {
+			return fmt.Errorf("could not get command %q of device %q: %w", commandID, deviceID, err)
+		}
+
+		name := topic.Slug(command.Name)
+		if name == "" || names[name] {
+			// Commands may have the same name, e.g. for different categories
+			name = strings.TrimPrefix(name+"_"+commandID, "_")
+		}
+		names[name] = true
+
+		if err := r.commandHandler(ctx, deviceID, commandID, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *relay) commandHandler(ctx context.Context, deviceID string, commandID string, name string) error {
+	topic := r.deviceTopic(deviceID, "commands/"+name)
+	return r.subscribeDevice(ctx, deviceID, topic, r.reportResult(topic, func(ctx context.Context, payload []byte) error {
+		if err := r.bridge.ExecuteCommand(ctx, deviceID, commandID); err != nil {
+			return fmt.Errorf("error executing command: %w", err)
+		}
+		return nil
+	}))
+}
+
+// publishDiscovery publishes retained Home Assistant discovery configs
+// for each entity derived from the device
+func (r *relay) publishDiscovery(deviceID string, d *bondhome.Device, properties *bondhome.DeviceProperties) error {
+	topics := homeassistant.DeviceTopics{
+		Action: func(actionID string) string {
+			return r.actionTopic(deviceID, actionID)
+		},
+		Dispatch:     r.actionTopic(deviceID, dispatchAction),
+		State:        r.stateTopic(deviceID),
+		Availability: []string{statusTopic(r.cfg), r.bridgeStatusTopic()},
+	}
+
+	entities := homeassistant.Entities(r.bondID, deviceID, d, properties, topics)
+	if len(entities) == 0 {
+		glog.Warningf("No Home Assistant entities for device %q of type %q", deviceID, d.Type)
+	}
+
+	for _, e := range entities {
+		payload, err := json.Marshal(e.Config)
+		if err != nil {
+			return fmt.Errorf("unable to marshal discovery config for device %q: %w", deviceID, err)
+		}
+
+		topic := e.DiscoveryTopic(r.cfg.DiscoveryPrefix)
+		policy := r.cfg.MQTT.MetadataPolicy()
+		token := r.mqtt.Publish(topic, policy.QoS, policy.Retain, payload)
+		if token.Wait() && token.Error() != nil {
+			return fmt.Errorf("unable to publish to topic %s: %w", topic, token.Error())
+		}
+		glog.Infoln("Published discovery config to topic", topic)
+
+		r.mu.Lock()
+		r.discoveryTopics[deviceID] = append(r.discoveryTopics[deviceID], topic)
+		r.mu.Unlock()
+	}
+
+	return nil
+}
+
+// publishInitialState publishes the device's current state as a retained message,
+// so that subscribers don't have to wait for the next BPUP update
+func (r *relay) publishInitialState(ctx context.Context, deviceID string) {
+	state, err := r.bridge.GetDeviceState(ctx, deviceID)
+	if err != nil {
+		glog.Errorf("Unable to get state of device %q: %v", deviceID, err)
+		return
+	}
+
+	r.publishState(r.stateTopic(deviceID), state)
+}
+
+// publishState publishes the state of a device or group as a retained message, and
+// each of its fields too if that is enabled, unless it is the same as the state last
+// published to the topic. If partial state is merged, state only needs to contain
+// the fields that have changed.
+func (r *relay) publishState(topic string, state json.RawMessage) {
+	r.mu.Lock()
+	previous, known := r.states[topic]
+	if r.cfg.MergeState && known {
+		merged, err := mergeState(previous, state)
+		if err != nil {
+			glog.Warningf("Unable to merge state published to %s, publishing it as it is: %v", topic, err)
+		} else {
+			state = merged
+		}
+	}
+	unchanged := known && sameState(previous, state)
+	if !unchanged {
+		r.states[topic] = state
+	}
+	r.mu.Unlock()
+
+	if unchanged {
+		glog.V(2).Infof("State published to %s is unchanged, not publishing it again", topic)
+		return
+	}
+
+	glog.V(1).Infof("Publishing to %s with body: %v", topic, string(state))
+	policy := r.cfg.MQTT.StatePolicy()
+	token := r.mqtt.Publish(topic, policy.QoS, policy.Retain, []byte(state))
+	if token.Wait() && token.Error() != nil {
+		glog.Errorf("Unable to publish to topic %s: %v", topic, token.Error())
+	}
+	if r.cfg.StateFields {
+		r.publishStateFields(topic, state)
+	}
+}
+
+// publishStateFields publishes each top-level field of a device's state
+// as a retained plain-text message to a subtopic of its state topic
+func (r *relay) publishStateFields(stateTopic string, state json.RawMessage) {
+	fields, err := stateFields(state)
+	if err != nil {
+		glog.Errorf("Unable to split state published to %s into fields: %v", stateTopic, err)
+		return
+	}
+
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	r.mu.Lock()
+	if r.fieldTopics[stateTopic] == nil {
+		r.fieldTopics[stateTopic] = make(map[string]bool)
+	}
+	for _, name := range names {
+		r.fieldTopics[stateTopic][stateTopic+"/"+name] = true
+	}
+	r.mu.Unlock()
+
+	policy := r.cfg.MQTT.StatePolicy()
+	for _, name := range names {
+		topic := stateTopic + "/" + name
+		glog.V(2).Infof("Publishing to %s with body: %v", topic, fields[name])
+		token := r.mqtt.Publish(topic, policy.QoS, policy.Retain, fields[name])
+		if token.Wait() && token.Error() != nil {
+			glog.Errorf("Unable to publish to topic %s: %v", topic, token.Error())
+		}
+	}
+}
+
+// mergeState returns the previous state of a device with the
+// top-level fields of update, which may be partial, replaced
+func mergeState(previous json.RawMessage, update json.RawMessage) (json.RawMessage, error) {
+	var merged map[string]json.RawMessage
+	if err := json.Unmarshal(previous, &merged); err != nil {
+		return nil, fmt.Errorf("previous state is not an object: %w", err)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(update, &fields); err != nil {
+		return nil, fmt.Errorf("state is not an object: %w", err)
+	}
+	for name, value := range fields {
+		merged[name] = value
+	}
+	return json.Marshal(merged)
+}
+
+// sameState reports whether two states are equal as JSON,
+// regardless of the order of their fields or whitespace
+func sameState(a json.RawMessage, b json.RawMessage) bool {
+	var va, vb interface{}
+	if json.Unmarshal(a, &va) != nil || json.Unmarshal(b, &vb) != nil {
+		return bytes.Equal(a, b)
+	}
+	return reflect.DeepEqual(va, vb)
+}
+
+// stateFields converts each top-level field of a state object to plain text:
+// strings are unquoted, null is empty and anything else is left as JSON
+func stateFields(state json.RawMessage) (map[string]string, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(state, &raw); err != nil {
+		return nil, err
+	}
+
+	fields := make(map[string]string, len(raw))
+	for name, value := range raw {
+		switch {
+		case bytes.Equal(value, []byte("null")):
+			fields[name] = ""
+		case len(value) > 0 && value[0] == '"':
+			var s string
+			if err := json.Unmarshal(value, &s); err != nil {
+				return nil, fmt.Errorf("error unmarshaling field %q: %w", name, err)
+			}
+			fields[name] = s
+		default:
+			fields[name] = string(value)
+		}
+	}
+	return fields, nil
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+	"testing"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+
+	"github.com/ssmall/bondhome-mqtt/bondhome"
+	"github.com/ssmall/bondhome-mqtt/config"
+)
+
+func Test_stateFields(t *testing.T) {
+	state := json.RawMessage(`{"power": 1, "speed": 3, "breeze": [0, 50, 50], "timer": null, "mode": "auto", "light": 0}`)
+
+	fields, err := stateFields(state)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := map[string]string{
+		"power":  "1",
+		"speed":  "3",
+		"breeze": "[0, 50, 50]",
+		"timer":  "",
+		"mode":   "auto",
+		"light":  "0",
+	}
+	if !reflect.DeepEqual(fields, expected) {
+		t.Fatalf("expected %v but got %v", expected, fields)
+	}
+}
+
+func Test_stateFields_notAnObject(t *testing.T) {
+	if _, err := stateFields(json.RawMessage(`[1, 2]`)); err == nil {
+		t.Fatalf("expected an error but got none")
+	}
+}
+
+func Test_mergeState(t *testing.T) {
+	merged, err := mergeState(json.RawMessage(`{"power": 1, "speed": 3}`), json.RawMessage(`{"speed": 4}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !sameState(merged, json.RawMessage(`{"power": 1, "speed": 4}`)) {
+		t.Fatalf("expected the speed to be merged into the previous state but got %s", merged)
+	}
+
+	if _, err := mergeState(json.RawMessage(`{"power": 1}`), json.RawMessage(`[1]`)); err == nil {
+		t.Fatalf("expected an error merging a state that isn't an object but got none")
+	}
+}
+
+func Test_sameState(t *testing.T) {
+	tests := []struct {
+		a, b string
+		same bool
+	}{
+		{`{"power": 1, "speed": 3}`, `{"speed":3,"power":1}`, true},
+		{`{"power": 1, "speed": 3}`, `{"power": 1, "speed": 4}`, false},
+		{`{"power": 1}`, `{"power": 1, "light": 0}`, false},
+		{`not json`, `not json`, true},
+	}
+	for _, tt := range tests {
+		if actual := sameState(json.RawMessage(tt.a), json.RawMessage(tt.b)); actual != tt.same {
+			t.Errorf("expected sameState(%s, %s) to be %v", tt.a, tt.b, tt.same)
+		}
+	}
+}
+
+func Test_relay_publishState(t *testing.T) {
+	cfg := config.Default()
+	cfg.MergeState = true
+	mqttClient := newFakeMQTT()
+	r := newRelay(cfg, mqttClient, nil, nil)
+	const topic = "bondhome/devices/aabbccdd/state"
+
+	r.publishState(topic, json.RawMessage(`{"power": 1, "speed": 3}`))
+	r.publishState(topic, json.RawMessage(`{"speed": 3, "power": 1}`))
+	if mqttClient.publishes[topic] != 1 {
+		t.Fatalf("expected an unchanged state to be published once but it was published %d times", mqttClient.publishes[topic])
+	}
+
+	r.publishState(topic, json.RawMessage(`{"speed": 4}`))
+	if mqttClient.publishes[topic] != 2 {
+		t.Fatalf("expected a changed state to be published again")
+	}
+	if !sameState(json.RawMessage(mqttClient.published[topic]), json.RawMessage(`{"power": 1, "speed": 4}`)) {
+		t.Fatalf("expected the partial state to be merged but got %s", mqttClient.published[topic])
+	}
+
+	r.clearRetained(topic)
+	r.publishState(topic, json.RawMessage(`{"power": 1, "speed": 4}`))
+	if mqttClient.publishes[topic] != 4 {
+		t.Fatalf("expected the state to be published again after being cleared")
+	}
+}
+
+func Test_newCommandResult(t *testing.T) {
+	statusErr := &bondhome.StatusError{Method: "PUT", URL: "http://bond/v2/devices/1/actions/TurnOn", StatusCode: http.StatusNotFound, Body: "{}"}
+	tests := []struct {
+		err      error
+		expected commandResult
+	}{
+		{nil, commandResult{Success: true}},
+		{fmt.Errorf("error executing action: %w", statusErr), commandResult{Status: http.StatusNotFound, Error: "error executing action: " + statusErr.Error()}},
+		{errors.New("action SetSpeed is not supported"), commandResult{Error: "action SetSpeed is not supported"}},
+	}
+	for _, tt := range tests {
+		if actual := newCommandResult(tt.err); actual != tt.expected {
+			t.Errorf("expected %+v but got %+v", tt.expected, actual)
+		}
+	}
+}
+
+func Test_relay_reportResult(t *testing.T) {
+	cfg := config.Default()
+	cfg.CommandResults = true
+	mqttClient := newFakeMQTT()
+	r := newRelay(cfg, mqttClient, nil, nil)
+	const topic = "bondhome/devices/aabbccdd/SetSpeed"
+
+	handle := r.reportResult(topic, func(context.Context, []byte) error {
+		return &bondhome.StatusError{StatusCode: http.StatusServiceUnavailable}
+	})
+	err := handle(bondhome.WithRequestID(context.Background(), "mqtt-1"), []byte("3"))
+	if err == nil {
+		t.Fatalf("expected the handler's error to be returned")
+	}
+
+	var result commandResult
+	if err := json.Unmarshal([]byte(mqttClient.published[topic+"/result"]), &result); err != nil {
+		t.Fatalf("expected a result to be published but got %q: %v", mqttClient.published[topic+"/result"], err)
+	}
+	if result.Success || result.RequestID != "mqtt-1" || result.Payload != "3" || result.Status != http.StatusServiceUnavailable || result.Error != err.Error() {
+		t.Errorf("unexpected result: %+v", result)
+	}
+}
+
+func Test_relay_subscribe_acks(t *testing.T) {
+	dialErr := &net.OpError{Op: "dial", Err: errors.New("connection refused")}
+	tests := []struct {
+		name      string
+		manualAck bool
+		err       error
+		acked     bool
+	}{
+		{"handled", true, nil, true},
+		{"invalid payload", true, errors.New("argument of action SetSpeed is not an integer"), true},
+		{"bridge unreachable", true, &bondhome.RequestError{Method: http.MethodPut, Err: dialErr}, false},
+		{"bridge busy", true, fmt.Errorf("error executing action: %w", &bondhome.StatusError{StatusCode: http.StatusServiceUnavailable}), false},
+		{"bridge may have acted", true, &bondhome.RequestError{Method: http.MethodPut, Err: context.DeadlineExceeded}, true},
+		{"automatic acks", false, dialErr, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.Default()
+			cfg.MQTT.ManualAck = tt.manualAck
+			mqttClient := newFakeMQTT()
+			r := newRelay(cfg, mqttClient, nil, nil)
+			const topic = "bondhome/devices/aabbccdd/TogglePower"
+
+			err := r.subscribe(context.Background(), topic, func(context.Context, []byte) error { return tt.err })
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			m := &fakeMessage{topic: topic}
+			mqttClient.handlers[topic](mqttClient, m)
+			if m.acked != tt.acked {
+				t.Errorf("expected acked=%v but got %v", tt.acked, m.acked)
+			}
+		})
+	}
+}
+
+// fakeRequest is an MQTT 5 message that asks to be replied to
+type fakeRequest struct {
+	fakeMessage
+
+	responseTopic   string
+	correlationData []byte
+	// reply is the payload it was replied to with
+	reply []byte
+}
+
+func (m *fakeRequest) ResponseTopic() string   { return m.responseTopic }
+func (m *fakeRequest) CorrelationData() []byte { return m.correlationData }
+
+func (m *fakeRequest) Reply(_ byte, payload []byte) paho.Token {
+	m.reply = payload
+	return doneToken{}
+}
+
+func Test_relay_subscribe_replies(t *testing.T) {
+	cfg := config.Default()
+	mqttClient := newFakeMQTT()
+	r := newRelay(cfg, mqttClient, nil, nil)
+	const topic = "bondhome/devices/aabbccdd/SetSpeed"
+
+	err := r.subscribe(context.Background(), topic, func(context.Context, []byte) error {
+		return fmt.Errorf("error executing action: %w", &bondhome.StatusError{StatusCode: http.StatusServiceUnavailable})
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	m := &fakeRequest{fakeMessage: fakeMessage{topic: topic, payload: []byte("3")}, responseTopic: "clients/1/replies"}
+	mqttClient.handlers[topic](mqttClient, m)
+
+	var result commandResult
+	if err := json.Unmarshal(m.reply, &result); err != nil {
+		t.Fatalf("expected a reply with the result but got %q: %v", m.reply, err)
+	}
+	if result.Success || result.RequestID == "" || result.Payload != "3" || result.Status != http.StatusServiceUnavailable || result.Error == "" {
+		t.Errorf("unexpected result: %+v", result)
+	}
+
+	// Messages without a response topic aren't replied to
+	m = &fakeRequest{fakeMessage: fakeMessage{topic: topic, payload: []byte("3")}}
+	mqttClient.handlers[topic](mqttClient, m)
+	if m.reply != nil {
+		t.Errorf("expected no reply but got %q", m.reply)
+	}
+}
+
+func Test_relay_updateTopic(t *testing.T) {
+	cfg := config.Default()
+	r := newRelay(cfg, newFakeMQTT(), nil, nil)
+	if err := r.addDevice("aabbccdd", &bondhome.Device{Name: "Fan", Type: "CF"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if topic, ok := r.updateTopic("devices/aabbccdd/state"); !ok || topic != "bondhome/devices/aabbccdd/state" {
+		t.Errorf("expected the state topic of a known device but got %q, %v", topic, ok)
+	}
+	if topic, ok := r.updateTopic("devices/11223344/state"); ok {
+		t.Errorf("expected the update of an unknown device to be dropped but got topic %q", topic)
+	}
+	select {
+	case <-r.refresh:
+	default:
+		t.Errorf("expected a refresh to be requested for the unknown device")
+	}
+}
+
+func Test_relay_updateTopic_templates(t *testing.T) {
+	cfg := config.Default()
+	cfg.Topics.Device = "home/{name}"
+	cfg.Topics.Group = "home/groups/{group_id}"
+	cfg.Topics.Bridge = "home/bond"
+	r := newRelay(cfg, newFakeMQTT(), nil, nil)
+	if err := r.addDevice("aabbccdd", &bondhome.Device{Name: "Fan", Type: "CF"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		bpupTopic string
+		expected  string
+	}{
+		{"devices/aabbccdd", "home/fan"},
+		{"devices/aabbccdd/properties", "home/fan/properties"},
+		{"groups/11223344", "home/groups/11223344"},
+		{"groups/11223344/state", "home/groups/11223344/state"},
+		{"bridge", "home/bond"},
+		{"sys/time", "bondhome/sys/time"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.bpupTopic, func(t *testing.T) {
+			if topic, ok := r.updateTopic(tt.bpupTopic); !ok || topic != tt.expected {
+				t.Errorf("expected %q but got %q, %v", tt.expected, topic, ok)
+			}
+		})
+	}
+}
+
+func Test_relay_addDevice_collision(t *testing.T) {
+	cfg := config.Default()
+	cfg.Topics.State = "home/{name}/state"
+	r := newRelay(cfg, newFakeMQTT(), nil, nil)
+	if err := r.addDevice("aabbccdd", &bondhome.Device{Name: "fan"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := r.addDevice("11223344", &bondhome.Device{Name: "fan"}); err == nil {
+		t.Fatalf("expected an error for devices with the same state topic")
+	}
+	if topic, ok := r.updateTopic("devices/11223344/state"); ok {
+		t.Errorf("expected the update of the colliding device to be dropped but got topic %q", topic)
+	}
+	for topic, deviceID := range r.topics {
+		if deviceID != "aabbccdd" {
+			t.Errorf("expected no topics of the colliding device but got %s", topic)
+		}
+	}
+}
+
+func Test_relay_clearRetained_stateFields(t *testing.T) {
+	cfg := config.Default()
+	cfg.StateFields = true
+	mqttClient := newFakeMQTT()
+	r := newRelay(cfg, mqttClient, nil, nil)
+	const topic = "bondhome/devices/aabbccdd/state"
+
+	r.publishState(topic, json.RawMessage(`{"power": 1, "speed": 3}`))
+	if mqttClient.published[topic+"/speed"] != "3" {
+		t.Fatalf("expected the speed field to be published but got %q", mqttClient.published[topic+"/speed"])
+	}
+
+	r.clearRetained(topic)
+	for _, cleared := range []string{topic, topic + "/power", topic + "/speed"} {
+		if mqttClient.publishes[cleared] != 2 || mqttClient.published[cleared] != "" {
+			t.Errorf("expected the retained message of %s to be cleared", cleared)
+		}
+	}
+}
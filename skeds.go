@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/ssmall/bondhome-mqtt/bondhome"
+)
+
+// skedResponse is published to a device's schedule response
+// topic after each request to manage its schedules
+type skedResponse struct {
+	// Request is the request that this is the response to, e.g. "create"
+	Request string `json:"request"`
+	// Skeds are the device's schedules, for "list", or the created schedule, for "create"
+	Skeds []*bondhome.Sked `json:"skeds,omitempty"`
+	// SkedID is the schedule that the request applied to
+	SkedID string `json:"sked_id,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// skedRequests handles each kind of request to manage a device's schedules,
+// named after the topic it is received on, filling in the response
+var skedRequests = map[string]func(ctx context.Context, r *relay, deviceID string, payload []byte, resp *skedResponse) error{
+	"list": func(ctx context.Context, r *relay, deviceID string, _ []byte, resp *skedResponse) error {
+		skedIDs, err := r.bridge.GetSkedIDs(ctx, deviceID)
+		if err != nil {
+			return err
+		}
+		resp.Skeds = make([]*bondhome.Sked, 0, len(skedIDs))
+		for _, skedID := range skedIDs {
+			sked, err := r.bridge.GetSked(ctx, deviceID, skedID)
+			if err != nil {
+				return err
+			}
+			resp.Skeds = append(resp.Skeds, sked)
+		}
+		return nil
+	},
+	"create": func(ctx context.Context, r *relay, deviceID string, payload []byte, resp *skedResponse) error {
+		sked := &bondhome.Sked{}
+		if err := json.Unmarshal(payload, sked); err != nil {
+			return fmt.Errorf("invalid schedule %q: %w", payload, err)
+		}
+		created, err := r.bridge.CreateSked(ctx, deviceID, sked)
+		if err != nil {
+			return err
+		}
+		resp.SkedID = created.ID
+		resp.Skeds = []*bondhome.Sked{created}
+		return nil
+	},
+	"enable": func(ctx context.Context, r *relay, deviceID string, payload []byte, resp *skedResponse) error {
+		return setSkedEnabled(ctx, r, deviceID, payload, resp, true)
+	},
+	"disable": func(ctx context.Context, r *relay, deviceID string, payload []byte, resp *skedResponse) error {
+		return setSkedEnabled(ctx, r, deviceID, payload, resp, false)
+	},
+	"delete": func(ctx context.Context, r *relay, deviceID string, payload []byte, resp *skedResponse) error {
+		resp.SkedID = strings.TrimSpace(string(payload))
+		if resp.SkedID == "" {
+			return fmt.Errorf("no schedule ID given")
+		}
+		return r.bridge.DeleteSked(ctx, deviceID, resp.SkedID)
+	},
+}
+
+func setSkedEnabled(ctx context.Context, r *relay, deviceID string, payload []byte, resp *skedResponse, enabled bool) error {
+	resp.SkedID = strings.TrimSpace(string(payload))
+	if resp.SkedID == "" {
+		return fmt.Errorf("no schedule ID given")
+	}
+	return r.bridge.PatchSked(ctx, deviceID, resp.SkedID, &bondhome.Sked{Enabled: &enabled})
+}
+
+// skedHandlers subscribes to a topic for each kind of request to manage the
+// device's schedules, e.g. skeds/create, each of which publishes a response
+func (r *relay) skedHandlers(ctx context.Context, deviceID string) error {
+	for request, handle := range skedRequests {
+		localRequest, localHandle := request, handle
+		err := r.subscribeDevice(ctx, deviceID, r.deviceTopic(deviceID, "skeds/"+localRequest), func(ctx context.Context, payload []byte) error {
+			resp := &skedResponse{Request: localRequest}
+			err := localHandle(ctx, r, deviceID, payload, resp)
+			if err != nil {
+				resp.Error = err.Error()
+				err = fmt.Errorf("error handling schedule request: %w", err)
+			}
+			r.publishSkedResponse(deviceID, resp)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *relay) publishSkedResponse(deviceID string, resp *skedResponse) {
+	payload, err := json.Marshal(resp)
+	if err != nil {
+		glog.Errorf("Unable to marshal schedule response for device %q: %v", deviceID, err)
+		return
+	}
+
+	topic := r.deviceTopic(deviceID, "skeds/response")
+	glog.V(1).Infof("Publishing to %s with body: %s", topic, payload)
+	token := r.mqtt.Publish(topic, r.cfg.MQTT.CommandPolicy().QoS, false, payload)
+	if token.Wait() && token.Error() != nil {
+		glog.Errorf("Unable to publish to topic %s: %v", topic, token.Error())
+	}
+}
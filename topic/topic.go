@@ -0,0 +1,120 @@
+// Package topic builds MQTT topics from templates such as
+// "home/{location}/{name}/set/{action}"
+package topic
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Placeholders that may appear in a Template
+const (
+	// Prefix is the configured topic prefix
+	Prefix = "prefix"
+	// BondID is the Bond ID of the device's bridge
+	BondID = "bond_id"
+	// Base is the prefix, followed by the Bond ID if topics are namespaced by bridge
+	Base = "base"
+	// DeviceID is the ID of the device
+	DeviceID = "device_id"
+	// Name is the name of the device, converted to lower_snake_case
+	Name = "name"
+	// Location is the location of the device, converted to lower_snake_case
+	Location = "location"
+	// Type is the type of the device, e.g. CF
+	Type = "type"
+	// Action is the name of the action that a command topic executes
+	Action = "action"
+	// GroupID is the ID of a group of devices
+	GroupID = "group_id"
+)
+
+var (
+	placeholderPattern = regexp.MustCompile(`\{([^{}]*)\}`)
+	slugPattern        = regexp.MustCompile(`[^a-z0-9]+`)
+
+	knownPlaceholders = map[string]bool{
+		Prefix: true, BondID: true, Base: true, DeviceID: true,
+		Name: true, Location: true, Type: true, Action: true, GroupID: true,
+	}
+)
+
+// Template is a topic containing placeholders, e.g. {device_id},
+// that are replaced with the values of Fields when rendered
+type Template string
+
+// Fields are the values substituted for a Template's placeholders
+type Fields struct {
+	Prefix   string
+	BondID   string
+	Base     string
+	DeviceID string
+	Name     string
+	Location string
+	Type     string
+	Action   string
+	GroupID  string
+}
+
+func (f Fields) value(placeholder string) string {
+	switch placeholder {
+	case Prefix:
+		return f.Prefix
+	case BondID:
+		return f.BondID
+	case Base:
+		return f.Base
+	case DeviceID:
+		return f.DeviceID
+	case Name:
+		return Slug(f.Name)
+	case Location:
+		return Slug(f.Location)
+	case Type:
+		return f.Type
+	case Action:
+		return f.Action
+	case GroupID:
+		return f.GroupID
+	}
+	return ""
+}
+
+// Render returns the topic with every placeholder replaced
+func (t Template) Render(f Fields) string {
+	return placeholderPattern.ReplaceAllStringFunc(string(t), func(p string) string {
+		return f.value(p[1 : len(p)-1])
+	})
+}
+
+// Uses reports whether the template contains the given placeholder
+func (t Template) Uses(placeholder string) bool {
+	return strings.Contains(string(t), "{"+placeholder+"}")
+}
+
+// Validate checks that the template only contains known placeholders
+// and is a valid topic to publish to
+func (t Template) Validate() error {
+	if t == "" {
+		return fmt.Errorf("must not be empty")
+	}
+	for _, m := range placeholderPattern.FindAllStringSubmatch(string(t), -1) {
+		if !knownPlaceholders[m[1]] {
+			return fmt.Errorf("unknown placeholder {%s}", m[1])
+		}
+	}
+	if strings.ContainsAny(string(t), "+#") {
+		return fmt.Errorf("must not contain wildcards")
+	}
+	if strings.HasPrefix(string(t), "/") || strings.HasSuffix(string(t), "/") {
+		return fmt.Errorf("must not start or end with '/'")
+	}
+	return nil
+}
+
+// Slug converts a name like "Living Room" to "living_room",
+// so that it can safely be used as a topic level
+func Slug(s string) string {
+	return strings.Trim(slugPattern.ReplaceAllString(strings.ToLower(s), "_"), "_")
+}
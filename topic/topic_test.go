@@ -0,0 +1,69 @@
+package topic
+
+import "testing"
+
+func Test_Template_Render(t *testing.T) {
+	fields := Fields{
+		Prefix:   "bondhome",
+		BondID:   "ZZBL12345",
+		Base:     "bondhome/ZZBL12345",
+		DeviceID: "aabbccdd",
+		Name:     "Ceiling Fan",
+		Location: "Living Room",
+		Type:     "CF",
+		Action:   "SetSpeed",
+		GroupID:  "11223344",
+	}
+	tests := []struct {
+		template Template
+		expected string
+	}{
+		{"{base}/devices/{device_id}/{action}", "bondhome/ZZBL12345/devices/aabbccdd/SetSpeed"},
+		{"home/{location}/{name}/set/{action}", "home/living_room/ceiling_fan/set/SetSpeed"},
+		{"{prefix}/{bond_id}/{type}/{device_id}", "bondhome/ZZBL12345/CF/aabbccdd"},
+		{"{base}/groups/{group_id}", "bondhome/ZZBL12345/groups/11223344"},
+		{"no/placeholders", "no/placeholders"},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.template), func(t *testing.T) {
+			if actual := tt.template.Render(fields); actual != tt.expected {
+				t.Fatalf("expected %q but got %q", tt.expected, actual)
+			}
+		})
+	}
+}
+
+func Test_Template_Validate(t *testing.T) {
+	tests := []struct {
+		template Template
+		valid    bool
+	}{
+		{"home/{location}/{name}/set/{action}", true},
+		{"", false},
+		{"home/{room}/{name}", false},
+		{"home/+/{name}", false},
+		{"/home/{name}", false},
+		{"home/{name}/", false},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.template), func(t *testing.T) {
+			if err := tt.template.Validate(); (err == nil) != tt.valid {
+				t.Fatalf("expected valid=%v but got error: %v", tt.valid, err)
+			}
+		})
+	}
+}
+
+func Test_Slug(t *testing.T) {
+	tests := map[string]string{
+		"Living Room":        "living_room",
+		"  Fan #2 (Patio) ":  "fan_2_patio",
+		"kitchen/island":     "kitchen_island",
+		"already_a_slug_123": "already_a_slug_123",
+	}
+	for input, expected := range tests {
+		if actual := Slug(input); actual != expected {
+			t.Errorf("expected Slug(%q) to be %q but got %q", input, expected, actual)
+		}
+	}
+}